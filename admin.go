@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/speady1445/web_server_course/internals/database"
+)
+
+// Largest snapshot accepted by the restore endpoint
+const maxRestoreSize = 256 << 20
+
+// isAdmin checks the request carries the admin API key.
+// Without ADMIN_API_KEY set nobody is admin.
+func (c *apiConfig) isAdmin(r *http.Request) bool {
+	return c.adminApiKey != "" && r.Header.Get("Authorization") == "ApiKey "+c.adminApiKey
+}
+
+func (c *apiConfig) handlerSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !c.isAdmin(r) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid API key")
+		return
+	}
+
+	snapshotter, ok := c.db.(database.Snapshotter)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Database backend does not support snapshots")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, database.SnapshotFileName(time.Now())))
+	w.WriteHeader(http.StatusOK)
+
+	err := snapshotter.Snapshot(w)
+	if err != nil {
+		// headers are gone already, all we can do is cut the response short
+		fmt.Println("Error writing snapshot:", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (c *apiConfig) handlerRestore(w http.ResponseWriter, r *http.Request) {
+	if !c.isAdmin(r) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid API key")
+		return
+	}
+
+	snapshotter, ok := c.db.(database.Snapshotter)
+	if !ok {
+		respondWithError(w, http.StatusNotImplemented, "Database backend does not support snapshots")
+		return
+	}
+
+	err := snapshotter.Restore(http.MaxBytesReader(w, r.Body, maxRestoreSize))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) || errors.Is(err, database.ErrSnapshotTooLarge) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Snapshot is too large")
+		return
+	}
+	if errors.Is(err, database.ErrInvalidSnapshot) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		fmt.Println("Error restoring snapshot:", err)
+		respondWithError(w, http.StatusInternalServerError, "Error restoring snapshot.")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
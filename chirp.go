@@ -1,169 +1,285 @@
-package main
-
-import (
-	"encoding/json"
-	"net/http"
-	"slices"
-	"strconv"
-	"strings"
-
-	"github.com/speady1445/web_server_course/internals/auth"
-	"github.com/speady1445/web_server_course/internals/database"
-)
-
-type responseChirp struct {
-	ID       int    `json:"id"`
-	AuthorID int    `json:"author_id"`
-	Body     string `json:"body"`
-}
-
-func dbChirpToResponseChirp(dbChirp database.Chirp) responseChirp {
-	return responseChirp{
-		ID:       dbChirp.Id,
-		AuthorID: dbChirp.AuthorID,
-		Body:     dbChirp.Body,
-	}
-}
-
-func (c *apiConfig) handlerAddChirp(w http.ResponseWriter, r *http.Request) {
-	type parameters struct {
-		Body  string `json:"body"`
-		Token string `json:"token"`
-	}
-
-	decoder := json.NewDecoder(r.Body)
-	params := parameters{}
-	err := decoder.Decode(&params)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid input")
-		return
-	}
-
-	userID, err := auth.GetUserIDFromAccessToken(c.jwtSecret, r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
-		return
-	}
-
-	if len(params.Body) > 140 {
-		respondWithError(w, http.StatusBadRequest, "Chirp is too long")
-		return
-	}
-
-	dbChirp, err := c.db.CreateChirp(userID, cleanedChirpMessage(params.Body))
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	respondWith(w, http.StatusCreated, dbChirpToResponseChirp(dbChirp))
-}
-
-func cleanedChirpMessage(text string) string {
-	bannedWords := map[string]struct{}{
-		"kerfuffle": {},
-		"sharbert":  {},
-		"fornax":    {},
-	}
-
-	words := strings.Split(text, " ")
-	for i, word := range words {
-		if _, ok := bannedWords[strings.ToLower(word)]; ok {
-			words[i] = "****"
-		}
-	}
-	return strings.Join(words, " ")
-}
-
-func (c *apiConfig) handlerGetChirps(w http.ResponseWriter, r *http.Request) {
-	dbChirps, err := c.db.GetChirps()
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	authorID := -1
-	authorIDstring := r.URL.Query().Get("author_id")
-	if authorIDstring != "" {
-		authorID, err = strconv.Atoi(authorIDstring)
-		if err != nil {
-			respondWithError(w, http.StatusBadRequest, "Invalid author id")
-			return
-		}
-	}
-
-	sortMode := r.URL.Query().Get("sort")
-	if sortMode == "" {
-		sortMode = "asc"
-	}
-	if sortMode != "asc" && sortMode != "desc" {
-		respondWithError(w, http.StatusBadRequest, "Invalid sort mode")
-	}
-
-	chirps := make([]responseChirp, 0, len(dbChirps))
-	for _, dbChirp := range dbChirps {
-		if authorID == -1 || authorID == dbChirp.AuthorID {
-			chirps = append(chirps, dbChirpToResponseChirp(dbChirp))
-		}
-	}
-
-	slices.SortFunc(chirps, func(a, b responseChirp) int {
-		if sortMode == "asc" {
-			return a.ID - b.ID
-		}
-		return b.ID - a.ID
-	})
-
-	respondWith(w, http.StatusOK, chirps)
-}
-
-func (c *apiConfig) handlerGetChirp(w http.ResponseWriter, r *http.Request) {
-	idStr := r.PathValue("chirpid")
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid chirp id.")
-		return
-	}
-
-	dbChirp, err := c.db.GetChirp(id)
-	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Chirp not found")
-		return
-	}
-
-	respondWith(w, http.StatusOK, dbChirpToResponseChirp(dbChirp))
-}
-
-func (c *apiConfig) handlerDeleteChirp(w http.ResponseWriter, r *http.Request) {
-	idStr := r.PathValue("chirpid")
-	inputID, err := strconv.Atoi(idStr)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid chirp id.")
-		return
-	}
-
-	authorID, err := auth.GetUserIDFromAccessToken(c.jwtSecret, r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Invalid access token.")
-		return
-	}
-
-	chirp, err := c.db.GetChirp(inputID)
-	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Chirp not found.")
-		return
-	}
-
-	if authorID != chirp.AuthorID {
-		respondWithError(w, http.StatusForbidden, "You can only delete your own chirps.")
-		return
-	}
-
-	err = c.db.DeleteChirp(inputID)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error deleting chirp.")
-		return
-	}
-
-	w.WriteHeader(http.StatusOK)
-}
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/speady1445/web_server_course/internals/database"
+	"github.com/speady1445/web_server_course/internals/search"
+)
+
+type responseChirp struct {
+	ID        int       `json:"id"`
+	AuthorID  int       `json:"author_id"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func dbChirpToResponseChirp(dbChirp database.Chirp) responseChirp {
+	return responseChirp{
+		ID:        dbChirp.Id,
+		AuthorID:  dbChirp.AuthorID,
+		Body:      dbChirp.Body,
+		CreatedAt: dbChirp.CreatedAt,
+		UpdatedAt: dbChirp.UpdatedAt,
+	}
+}
+
+func (c *apiConfig) handlerAddChirp(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Body  string `json:"body"`
+		Token string `json:"token"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid input")
+		return
+	}
+
+	claims, err := c.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	userID := claims.UserID
+
+	if len(params.Body) > 140 {
+		respondWithError(w, http.StatusBadRequest, "Chirp is too long")
+		return
+	}
+
+	dbChirp, err := c.db.CreateChirp(userID, cleanedChirpMessage(params.Body))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWith(w, http.StatusCreated, dbChirpToResponseChirp(dbChirp))
+}
+
+func cleanedChirpMessage(text string) string {
+	bannedWords := map[string]struct{}{
+		"kerfuffle": {},
+		"sharbert":  {},
+		"fornax":    {},
+	}
+
+	words := strings.Split(text, " ")
+	for i, word := range words {
+		if _, ok := bannedWords[strings.ToLower(word)]; ok {
+			words[i] = "****"
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// handlerGetChirps returns one page of the chirps matching the query parameters,
+// by default the first DefaultPageLimit chirps ordered by ID.
+// The cursors of the pages around it are in the Link header
+// and in X-Next-Cursor and X-Prev-Cursor.
+func (c *apiConfig) handlerGetChirps(w http.ResponseWriter, r *http.Request) {
+	params := newQueryParser(r)
+
+	query := database.ChirpQuery{
+		AuthorIDs:        params.ids("author_id"),
+		ExcludeAuthorIDs: params.ids("exclude_author_id"),
+		CreatedAfter:     params.time("created_after"),
+		CreatedBefore:    params.time("created_before"),
+		BodyContains:     params.string("contains"),
+		Descending:       params.oneOf("sort", "asc", "asc", "desc") == "desc",
+		Limit:            params.intRange("limit", database.DefaultPageLimit, 1, database.MaxPageLimit),
+		Cursor:           params.string("cursor"),
+	}
+	// chirps have no likes or media yet: sorting by likes and has_media are
+	// rejected with 400 instead of being ignored, until chirps get those fields
+	if params.string("sort_by") == "likes" {
+		params.fail("sort_by", "chirps have no likes to sort by")
+	} else if params.oneOf("sort_by", "id", "created_at", "id") == "id" {
+		// by ID unless asked otherwise, the order the endpoint had before pagination
+		query.OrderBy = database.OrderByID
+	}
+	params.unsupported("has_media", "chirps have no media to filter by")
+
+	if !params.ok() {
+		params.respondWithInvalid(w)
+		return
+	}
+
+	page, err := c.db.GetChirpsPage(query)
+	if errors.Is(err, database.ErrInvalidCursor) {
+		respondWithError(w, http.StatusBadRequest, "Invalid cursor")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	chirps := make([]responseChirp, 0, len(page.Chirps))
+	for _, dbChirp := range page.Chirps {
+		chirps = append(chirps, dbChirpToResponseChirp(dbChirp))
+	}
+
+	setPageHeaders(w, r, page)
+	respondWith(w, http.StatusOK, chirps)
+}
+
+// setPageHeaders links the pages around the current one
+func setPageHeaders(w http.ResponseWriter, r *http.Request, page database.ChirpPage) {
+	links := []string{}
+	link := func(rel, cursor string) {
+		query := r.URL.Query()
+		query.Set("cursor", cursor)
+		u := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+		links = append(links, fmt.Sprintf(`<%s>; rel="%s"`, u.String(), rel))
+	}
+
+	if page.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", page.NextCursor)
+		link("next", page.NextCursor)
+	}
+	if page.PrevCursor != "" {
+		w.Header().Set("X-Prev-Cursor", page.PrevCursor)
+		link("prev", page.PrevCursor)
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
+
+func (c *apiConfig) handlerGetChirp(w http.ResponseWriter, r *http.Request) {
+	idStr := r.PathValue("chirpid")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp id.")
+		return
+	}
+
+	dbChirp, err := c.db.GetChirp(id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Chirp not found")
+		return
+	}
+
+	respondWith(w, http.StatusOK, dbChirpToResponseChirp(dbChirp))
+}
+
+func (c *apiConfig) handlerDeleteChirp(w http.ResponseWriter, r *http.Request) {
+	idStr := r.PathValue("chirpid")
+	inputID, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp id.")
+		return
+	}
+
+	claims, err := c.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid access token.")
+		return
+	}
+	authorID := claims.UserID
+
+	err = c.db.DeleteChirpByAuthor(inputID, authorID)
+	if errors.Is(err, database.ErrNotExists) {
+		respondWithError(w, http.StatusNotFound, "Chirp not found.")
+		return
+	}
+	if errors.Is(err, database.ErrNotOwner) {
+		respondWithError(w, http.StatusForbidden, "You can only delete your own chirps.")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error deleting chirp.")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (c *apiConfig) handlerRestoreChirp(w http.ResponseWriter, r *http.Request) {
+	idStr := r.PathValue("chirpid")
+	inputID, err := strconv.Atoi(idStr)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp id.")
+		return
+	}
+
+	claims, err := c.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid access token.")
+		return
+	}
+	authorID := claims.UserID
+
+	dbChirp, err := c.db.RestoreChirpByAuthor(inputID, authorID, time.Now().Add(-c.restoreWindow))
+	if errors.Is(err, database.ErrNotExists) {
+		respondWithError(w, http.StatusNotFound, "Chirp not found.")
+		return
+	}
+	if errors.Is(err, database.ErrNotOwner) {
+		respondWithError(w, http.StatusForbidden, "You can only restore your own chirps.")
+		return
+	}
+	if errors.Is(err, database.ErrNotDeleted) {
+		respondWithError(w, http.StatusConflict, "Chirp is not deleted.")
+		return
+	}
+	if errors.Is(err, database.ErrRestoreExpired) {
+		respondWithError(w, http.StatusGone, "Chirp was deleted too long ago to restore.")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error restoring chirp.")
+		return
+	}
+
+	respondWith(w, http.StatusOK, dbChirpToResponseChirp(dbChirp))
+}
+
+// handlerSearchChirps returns the chirps containing all words and "phrases" of q,
+// best match first
+func (c *apiConfig) handlerSearchChirps(w http.ResponseWriter, r *http.Request) {
+	if c.searchIndex == nil {
+		respondWithError(w, http.StatusNotImplemented, "Database backend does not support search")
+		return
+	}
+
+	params := newQueryParser(r)
+	q := params.string("q")
+	if len(search.Tokenize(q)) == 0 {
+		params.fail("q", "must contain at least one word")
+	}
+	limit := params.intRange("limit", database.DefaultPageLimit, 1, database.MaxPageLimit)
+	if !params.ok() {
+		params.respondWithInvalid(w)
+		return
+	}
+
+	results, err := c.searchIndex.Search(q, limit)
+	if err != nil {
+		respondWithError(w, http.StatusServiceUnavailable, "Search is unavailable.")
+		return
+	}
+
+	chirps := make([]responseChirp, 0, len(results))
+	for _, result := range results {
+		dbChirp, err := c.db.GetChirp(result.ID)
+		if err != nil {
+			// deleted since it was found
+			continue
+		}
+		chirps = append(chirps, dbChirpToResponseChirp(dbChirp))
+	}
+
+	respondWith(w, http.StatusOK, chirps)
+}
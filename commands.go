@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/speady1445/web_server_course/internals/auth"
+	"github.com/speady1445/web_server_course/internals/database"
+)
+
+func planMigrations(encryptionKey []byte) error {
+	planned, err := database.PlanMigrations(dbPath, encryptionKey)
+	if err != nil {
+		return err
+	}
+
+	if len(planned) == 0 {
+		fmt.Println("Database is up to date")
+		return nil
+	}
+	fmt.Println("Migrations to run:")
+	for _, description := range planned {
+		fmt.Println("  " + description)
+	}
+	return nil
+}
+
+// rotateSigningKey adds a new token signing key to the keyring file.
+// Meant to be run on a schedule, like a monthly cron job.
+func rotateSigningKey(legacySecret string, rotation auth.Rotation) error {
+	result, err := auth.RotateKeyring(keyringPath, legacySecret, rotation)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Tokens are now signed with key " + result.Added)
+	for _, id := range result.Removed {
+		fmt.Println("Removed key " + id + ", tokens signed with it are no longer valid")
+	}
+	return nil
+}
+
+// rotateEncryptionKey re-encrypts the database with the key in DB_ENCRYPTION_KEY_NEW
+func rotateEncryptionKey(backend string, opts database.Options) error {
+	encoded, found := os.LookupEnv("DB_ENCRYPTION_KEY_NEW")
+	if !found {
+		return errors.New("DB_ENCRYPTION_KEY_NEW not found")
+	}
+	newKey, err := database.ParseEncryptionKey(encoded)
+	if err != nil {
+		return err
+	}
+
+	store, err := openStore(backend, opts)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	db, ok := store.(*database.DB)
+	if !ok {
+		return fmt.Errorf("the %s backend does not support encryption", backend)
+	}
+
+	err = db.RotateKey(newKey)
+	if errors.Is(err, database.ErrRotationIncomplete) {
+		return fmt.Errorf("%w\nset DB_ENCRYPTION_KEY to the value of DB_ENCRYPTION_KEY_NEW before opening the database again", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Database re-encrypted, set DB_ENCRYPTION_KEY to the value of DB_ENCRYPTION_KEY_NEW")
+	return nil
+}
+
+// openSnapshotter opens the database of a backend that supports snapshots
+func openSnapshotter(backend string, opts database.Options) (database.Store, database.Snapshotter, error) {
+	store, err := openStore(backend, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	snapshotter, ok := store.(database.Snapshotter)
+	if !ok {
+		store.Close()
+		return nil, nil, fmt.Errorf("the %s backend does not support snapshots", backend)
+	}
+	return store, snapshotter, nil
+}
+
+// saveSnapshot writes a timestamped snapshot of the database to the current directory
+func saveSnapshot(backend string, opts database.Options) error {
+	store, snapshotter, err := openSnapshotter(backend, opts)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	name := database.SnapshotFileName(time.Now())
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = snapshotter.Snapshot(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name)
+		return err
+	}
+
+	fmt.Println("Snapshot saved to " + name)
+	return nil
+}
+
+// restoreSnapshot replaces the database with the snapshot in the given file
+func restoreSnapshot(backend string, opts database.Options, path string) error {
+	store, snapshotter, err := openSnapshotter(backend, opts)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = snapshotter.Restore(file)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Database restored from " + path)
+	return nil
+}
+
+// exportData writes the whole database to files in dir
+func exportData(backend string, opts database.Options, dir string, format database.Format) error {
+	store, err := openStore(backend, opts)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	db, ok := store.(*database.DB)
+	if !ok {
+		return fmt.Errorf("the %s backend does not support export", backend)
+	}
+
+	report, err := db.Export(dir, format, printProgress)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Exported %d users, %d chirps and %d revoked tokens to %s\n",
+		report.Users, report.Chirps, report.RevokedTokens, dir)
+	return nil
+}
+
+// importData adds the records exported to dir to the database
+func importData(backend string, opts database.Options, dir string, format database.Format, onConflict string) error {
+	policy, err := database.ParseConflictPolicy(onConflict)
+	if err != nil {
+		return err
+	}
+
+	store, err := openStore(backend, opts)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	db, ok := store.(*database.DB)
+	if !ok {
+		return fmt.Errorf("the %s backend does not support import", backend)
+	}
+
+	report, err := db.Import(dir, database.ImportOptions{
+		Format:     format,
+		OnConflict: policy,
+		Progress:   printProgress,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %d users, %d chirps and %d revoked tokens from %s\n",
+		report.Users, report.Chirps, report.RevokedTokens, dir)
+	if report.Skipped > 0 || report.Overwritten > 0 {
+		fmt.Printf("Users with an email already taken: %d skipped with %d chirps, %d overwritten\n",
+			report.Skipped, report.SkippedChirps, report.Overwritten)
+	}
+	return nil
+}
+
+func printProgress(report database.TransferReport) {
+	fmt.Printf("  users: %d, chirps: %d, revoked tokens: %d\n",
+		report.Users+report.Skipped+report.Overwritten, report.Chirps+report.SkippedChirps, report.RevokedTokens)
+}
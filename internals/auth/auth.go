@@ -1,119 +1,249 @@
-package auth
-
-import (
-	"errors"
-	"net/http"
-	"strconv"
-	"strings"
-	"time"
-
-	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
-)
-
-var (
-	accessToken = TokenType{
-		Issuer:             "chirpy-access",
-		expirationDuration: time.Duration(60*60) * time.Second,
-	}
-	refreshToken = TokenType{
-		Issuer:             "chirpy-refresh",
-		expirationDuration: time.Duration(60*60*24*60) * time.Second,
-	}
-)
-
-type TokenType struct {
-	Issuer             string
-	expirationDuration time.Duration
-}
-
-func HashPassword(password string) (string, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return "", err
-	}
-	return string(hash), nil
-}
-
-func CheckPassword(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
-}
-
-func GetAccessToken(secret string, userID int) (string, error) {
-	return getToken(secret, userID, accessToken)
-}
-func GetRefreshToken(secret string, userID int) (string, error) {
-	return getToken(secret, userID, refreshToken)
-}
-
-func getToken(secret string, userID int, tokenData TokenType) (string, error) {
-	currentUTC := time.Now().UTC()
-	expiresAt := currentUTC.Add(tokenData.expirationDuration)
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    tokenData.Issuer,
-		IssuedAt:  jwt.NewNumericDate(currentUTC),
-		ExpiresAt: jwt.NewNumericDate(expiresAt),
-		Subject:   strconv.Itoa(userID),
-	})
-
-	return token.SignedString([]byte(secret))
-}
-
-// GetUserID returns the user ID from a signed access token
-// Returns error in case token is invalid or missing
-func GetUserIDFromAccessToken(secret string, headers http.Header) (userID int, err error) {
-	return getUserIDFromToken(secret, headers, accessToken)
-}
-
-// GetUserID returns the user ID from a signed refresh token
-// Returns error in case token is invalid or missing
-func GetUserIDFromRefreshToken(secret string, headers http.Header) (userID int, err error) {
-	return getUserIDFromToken(secret, headers, refreshToken)
-}
-
-func getUserIDFromToken(secret string, headers http.Header, tokenData TokenType) (userID int, err error) {
-	tokenString, err := GetTokenFromHeaders(headers)
-	if err != nil {
-		return 0, err
-	}
-
-	claim := &jwt.RegisteredClaims{}
-	token, err := jwt.ParseWithClaims(tokenString, claim, func(token *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	})
-	if err != nil {
-		return 0, err
-	}
-
-	stringID, err := token.Claims.GetSubject()
-	if err != nil {
-		return 0, errors.New("invalid token")
-	}
-
-	if issuer, err := token.Claims.GetIssuer(); err != nil || issuer != tokenData.Issuer {
-		return 0, errors.New("invalid token")
-	}
-
-	id, err := strconv.Atoi(stringID)
-	if err != nil {
-		return 0, errors.New("invalid token")
-	}
-
-	return id, nil
-}
-
-func GetTokenFromHeaders(headers http.Header) (string, error) {
-	auth := headers.Get("Authorization")
-	if auth == "" {
-		return "", errors.New("missing authorization header")
-	}
-
-	authSplited := strings.Split(auth, " ")
-	if authSplited[0] != "Bearer" || len(authSplited) != 2 {
-		return "", errors.New("invalid authorization header")
-	}
-
-	return authSplited[1], nil
-}
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	accessToken = TokenType{
+		Issuer:             "chirpy-access",
+		expirationDuration: time.Duration(60*60) * time.Second,
+	}
+	// refreshToken is how refresh tokens were issued before they were opaque
+	refreshToken = TokenType{
+		Issuer:             "chirpy-refresh",
+		expirationDuration: RefreshTokenLifetime,
+	}
+)
+
+type TokenType struct {
+	Issuer             string
+	expirationDuration time.Duration
+}
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func CheckPassword(password, hash string) bool {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	return err == nil
+}
+
+// AccessClaims are what an access token says about its holder
+type AccessClaims struct {
+	// ID is the jti of the token, to deny it before it expires.
+	// Empty for tokens from before tokens had IDs.
+	ID        string
+	ExpiresAt time.Time
+	UserID    int
+	// SessionID is the login the token was issued for,
+	// empty for tokens from before sessions
+	SessionID string
+	// TokenVersion has to match the user's for the token to be accepted
+	TokenVersion int
+}
+
+// NewAccessClaims returns claims with a new token ID and expiry,
+// so they can be recorded before the token is signed
+func NewAccessClaims() (AccessClaims, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return AccessClaims{}, err
+	}
+
+	// JWTs store whole seconds
+	expiresAt := time.Now().UTC().Add(accessToken.expirationDuration).Truncate(time.Second)
+	return AccessClaims{ID: hex.EncodeToString(id), ExpiresAt: expiresAt}, nil
+}
+
+// tokenClaims are the JWT claims of all tokens
+type tokenClaims struct {
+	jwt.RegisteredClaims
+	SessionID    string `json:"sid,omitempty"`
+	TokenVersion int    `json:"ver,omitempty"`
+}
+
+// GetAccessToken signs an access token with the claims.
+// Claims without ID and expiry get new ones, see NewAccessClaims.
+func GetAccessToken(keys *Keyring, claims AccessClaims) (string, error) {
+	if claims.ID == "" {
+		fresh, err := NewAccessClaims()
+		if err != nil {
+			return "", err
+		}
+		claims.ID, claims.ExpiresAt = fresh.ID, fresh.ExpiresAt
+	}
+
+	return getToken(keys, accessToken, tokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        claims.ID,
+			Subject:   strconv.Itoa(claims.UserID),
+			ExpiresAt: jwt.NewNumericDate(claims.ExpiresAt),
+		},
+		SessionID:    claims.SessionID,
+		TokenVersion: claims.TokenVersion,
+	})
+}
+
+// getToken signs a token with the newest key of the keyring, naming the key in the kid header
+func getToken(keys *Keyring, tokenData TokenType, claims tokenClaims) (string, error) {
+	key, err := keys.signingKey()
+	if err != nil {
+		return "", err
+	}
+
+	currentUTC := time.Now().UTC()
+
+	claims.Issuer = tokenData.Issuer
+	claims.IssuedAt = jwt.NewNumericDate(currentUTC)
+	if claims.ExpiresAt == nil {
+		claims.ExpiresAt = jwt.NewNumericDate(currentUTC.Add(tokenData.expirationDuration))
+	}
+
+	token := jwt.NewWithClaims(key.signingMethod(), claims)
+	token.Header["kid"] = key.ID
+
+	return token.SignedString(key.signingKey())
+}
+
+// ParseAccessToken returns the claims of a signed access token.
+// It doesn't know whether the user's TokenVersion still matches or the token was denied.
+// Returns error in case token is invalid or missing
+func ParseAccessToken(keys *Keyring, headers http.Header) (AccessClaims, error) {
+	token, err := parseToken(keys, headers, accessToken)
+	if err != nil {
+		return AccessClaims{}, err
+	}
+
+	claims, ok := token.Claims.(*tokenClaims)
+	if !ok {
+		return AccessClaims{}, errors.New("invalid token")
+	}
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return AccessClaims{}, errors.New("invalid token")
+	}
+
+	expiresAt := time.Time{}
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+
+	return AccessClaims{
+		ID:           claims.ID,
+		ExpiresAt:    expiresAt,
+		UserID:       id,
+		SessionID:    claims.SessionID,
+		TokenVersion: claims.TokenVersion,
+	}, nil
+}
+
+// GetUserID returns the user ID from a legacy signed refresh token
+// Returns error in case token is invalid or missing
+func GetUserIDFromRefreshToken(keys *Keyring, headers http.Header) (userID int, err error) {
+	return getUserIDFromToken(keys, headers, refreshToken)
+}
+
+// GetRefreshTokenExpiry returns when a legacy signed refresh token expires
+// Returns error in case token is invalid or missing
+func GetRefreshTokenExpiry(keys *Keyring, headers http.Header) (time.Time, error) {
+	token, err := parseToken(keys, headers, refreshToken)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	expiresAt, err := token.Claims.GetExpirationTime()
+	if err != nil || expiresAt == nil {
+		return time.Time{}, errors.New("invalid token")
+	}
+
+	return expiresAt.Time, nil
+}
+
+func getUserIDFromToken(keys *Keyring, headers http.Header, tokenData TokenType) (userID int, err error) {
+	token, err := parseToken(keys, headers, tokenData)
+	if err != nil {
+		return 0, err
+	}
+
+	stringID, err := token.Claims.GetSubject()
+	if err != nil {
+		return 0, errors.New("invalid token")
+	}
+
+	id, err := strconv.Atoi(stringID)
+	if err != nil {
+		return 0, errors.New("invalid token")
+	}
+
+	return id, nil
+}
+
+// parseToken validates the token in the headers with the key named by its kid header
+// and checks it is of the expected type. Tokens without kid are from before the keyring.
+func parseToken(keys *Keyring, headers http.Header, tokenData TokenType) (*jwt.Token, error) {
+	tokenString, err := GetTokenFromHeaders(headers)
+	if err != nil {
+		return nil, err
+	}
+
+	claim := &tokenClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claim, func(token *jwt.Token) (interface{}, error) {
+		kid := LegacyKeyID
+		if value, found := token.Header["kid"]; found {
+			id, ok := value.(string)
+			if !ok {
+				return nil, errors.New("invalid key id")
+			}
+			kid = id
+		}
+
+		key, found := keys.verificationKey(kid)
+		if !found {
+			return nil, errors.New("unknown signing key")
+		}
+		// a token may not pick how the key is used
+		if token.Method.Alg() != key.algorithm() {
+			return nil, errors.New("signing method does not match key")
+		}
+		return key.verificationKey(), nil
+	}, jwt.WithValidMethods([]string{AlgorithmHS256, AlgorithmEdDSA, AlgorithmRS256}))
+	if err != nil {
+		return nil, err
+	}
+
+	if issuer, err := token.Claims.GetIssuer(); err != nil || issuer != tokenData.Issuer {
+		return nil, errors.New("invalid token")
+	}
+
+	return token, nil
+}
+
+func GetTokenFromHeaders(headers http.Header) (string, error) {
+	auth := headers.Get("Authorization")
+	if auth == "" {
+		return "", errors.New("missing authorization header")
+	}
+
+	authSplited := strings.Split(auth, " ")
+	if authSplited[0] != "Bearer" || len(authSplited) != 2 {
+		return "", errors.New("invalid authorization header")
+	}
+
+	return authSplited[1], nil
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestJWKSPublishesPublicKeysOnly(t *testing.T) {
+	edKey := testEdDSAKey(t, "ed")
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate RSA key: %v", err)
+	}
+	rsaKey := Key{ID: "rsa", Algorithm: AlgorithmRS256, private: rsaPrivate}
+	keys := NewKeyring(Key{ID: "hs", Secret: []byte("secret")}, edKey, rsaKey)
+
+	set := keys.JWKS()
+	if len(set.Keys) != 2 {
+		t.Fatalf("JWKS has %d keys, want the EdDSA and RS256 keys: %+v", len(set.Keys), set.Keys)
+	}
+
+	ed := set.Keys[0]
+	if ed.KeyID != "ed" || ed.KeyType != "OKP" || ed.Curve != "Ed25519" || ed.Algorithm != AlgorithmEdDSA || ed.Use != "sig" {
+		t.Errorf("Ed25519 JWK = %+v", ed)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(ed.X)
+	if err != nil || !bytes.Equal(x, edKey.private.Public().(ed25519.PublicKey)) {
+		t.Errorf("Ed25519 JWK x = %q, %v, want the public key", ed.X, err)
+	}
+
+	rs := set.Keys[1]
+	if rs.KeyID != "rsa" || rs.KeyType != "RSA" || rs.Algorithm != AlgorithmRS256 || rs.Use != "sig" || rs.Curve != "" {
+		t.Errorf("RSA JWK = %+v", rs)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(rs.Modulus)
+	if err != nil || new(big.Int).SetBytes(n).Cmp(rsaPrivate.N) != 0 {
+		t.Errorf("RSA JWK n = %q, %v, want the modulus", rs.Modulus, err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(rs.Exponent)
+	if err != nil || new(big.Int).SetBytes(e).Int64() != int64(rsaPrivate.E) {
+		t.Errorf("RSA JWK e = %q, %v, want %d", rs.Exponent, err, rsaPrivate.E)
+	}
+
+	content, err := json.Marshal(set)
+	if err != nil {
+		t.Fatalf("marshal JWKS: %v", err)
+	}
+	for _, private := range []string{`"d"`, `"p"`, `"q"`, "secret", base64.RawURLEncoding.EncodeToString([]byte("secret"))} {
+		if strings.Contains(string(content), private) {
+			t.Errorf("JWKS %s contains %s", content, private)
+		}
+	}
+}
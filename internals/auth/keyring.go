@@ -0,0 +1,384 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// LegacyKeyID identifies the JWT_SECRET key. Tokens signed before
+// keys had IDs carry no kid and are verified with it.
+const LegacyKeyID = "legacy"
+
+// Signing algorithms, named like the JWT alg header
+const (
+	AlgorithmHS256 = "HS256"
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmRS256 = "RS256"
+)
+
+// Key is a token signing key: a shared secret for HS256,
+// or a private key in a PEM file for EdDSA and RS256
+type Key struct {
+	ID string `json:"kid"`
+	// Algorithm is HS256 if empty
+	Algorithm string `json:"alg,omitempty"`
+	Secret    []byte `json:"secret,omitempty"`
+	// PrivateKeyFile is relative to the keyring file
+	PrivateKeyFile string    `json:"private_key_file,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	// RetiringSince is when a newer key took over signing.
+	// A retiring key still verifies tokens until it is removed from the keyring.
+	RetiringSince *time.Time `json:"retiring_since,omitempty"`
+
+	// private is read from PrivateKeyFile
+	private crypto.Signer
+}
+
+func (key Key) algorithm() string {
+	if key.Algorithm == "" {
+		return AlgorithmHS256
+	}
+	return key.Algorithm
+}
+
+// signingMethod returns how tokens are signed with the key
+func (key Key) signingMethod() jwt.SigningMethod {
+	return jwt.GetSigningMethod(key.algorithm())
+}
+
+// signingKey returns what the signing method signs with
+func (key Key) signingKey() any {
+	if key.private != nil {
+		return key.private
+	}
+	return key.Secret
+}
+
+// verificationKey returns what the signing method verifies with
+func (key Key) verificationKey() any {
+	if key.private != nil {
+		return key.private.Public()
+	}
+	return key.Secret
+}
+
+// loadPrivateKey reads the PEM file of an EdDSA or RS256 key
+func (key *Key) loadPrivateKey(dir string) error {
+	switch key.algorithm() {
+	case AlgorithmHS256:
+		if len(key.Secret) == 0 {
+			return fmt.Errorf("key %s has no secret", key.ID)
+		}
+		return nil
+	case AlgorithmEdDSA, AlgorithmRS256:
+	default:
+		return fmt.Errorf("key %s: unsupported algorithm %q", key.ID, key.Algorithm)
+	}
+
+	path := key.PrivateKeyFile
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	private, err := ReadPrivateKeyFile(path)
+	if err != nil {
+		return fmt.Errorf("key %s: %w", key.ID, err)
+	}
+	if algorithmOf(private) != key.algorithm() {
+		return fmt.Errorf("key %s: %s is not an %s key", key.ID, key.PrivateKeyFile, key.algorithm())
+	}
+	key.private = private
+	return nil
+}
+
+// KeyringReloadInterval is how often a keyring loaded from a file
+// checks whether the file changed
+const KeyringReloadInterval = 10 * time.Second
+
+// Keyring holds the keys tokens are signed and verified with.
+// The newest key signs, all keys verify.
+// A keyring loaded from a file picks up changes to the file, like a rotation,
+// within KeyringReloadInterval.
+type Keyring struct {
+	path    string
+	mux     sync.RWMutex
+	keys    []Key
+	modTime time.Time
+	// reloadInterval is KeyringReloadInterval, shorter in tests
+	reloadInterval time.Duration
+	// checkedAt is when the file was last checked, in Unix nanoseconds
+	checkedAt atomic.Int64
+}
+
+type keyringFile struct {
+	Keys []Key `json:"keys"`
+}
+
+// NewKeyring returns a keyring of fixed keys, oldest first
+func NewKeyring(keys ...Key) *Keyring {
+	return &Keyring{keys: keys}
+}
+
+// legacyKey is JWT_SECRET as a key
+func legacyKey(secret string) Key {
+	return Key{ID: LegacyKeyID, Secret: []byte(secret)}
+}
+
+// LoadKeyring reads the keyring file at path. Until the file exists
+// tokens are signed and verified with legacySecret alone.
+func LoadKeyring(path, legacySecret string) (*Keyring, error) {
+	k := &Keyring{path: path, reloadInterval: KeyringReloadInterval}
+	if legacySecret != "" {
+		k.keys = []Key{legacyKey(legacySecret)}
+	}
+
+	k.checkedAt.Store(time.Now().UnixNano())
+	err := k.reloadIfChanged()
+	if err != nil {
+		return nil, err
+	}
+	if len(k.keys) == 0 {
+		return nil, fmt.Errorf("no signing keys: set JWT_SECRET or create %s with -rotate-jwt-key", path)
+	}
+	return k, nil
+}
+
+// reloadIfDue checks the file for changes if it was last checked
+// more than reloadInterval ago, so tokens are not signed and verified
+// with a stat of the file each. Only one caller checks at a time.
+func (k *Keyring) reloadIfDue() error {
+	if k.path == "" {
+		return nil
+	}
+	checkedAt := k.checkedAt.Load()
+	now := time.Now().UnixNano()
+	if time.Duration(now-checkedAt) < k.reloadInterval || !k.checkedAt.CompareAndSwap(checkedAt, now) {
+		return nil
+	}
+	return k.reloadIfChanged()
+}
+
+// reloadIfChanged reads the file again if it was modified since it was last read
+func (k *Keyring) reloadIfChanged() error {
+	if k.path == "" {
+		return nil
+	}
+
+	info, err := os.Stat(k.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	k.mux.RLock()
+	unchanged := info.ModTime().Equal(k.modTime)
+	k.mux.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	keys, err := readKeyringFile(k.path)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("keyring %s has no keys", k.path)
+	}
+
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	k.keys = keys
+	k.modTime = info.ModTime()
+	return nil
+}
+
+// signingKey returns the newest key
+func (k *Keyring) signingKey() (Key, error) {
+	// keep using the keys already loaded if the file can't be read
+	_ = k.reloadIfDue()
+
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+
+	if len(k.keys) == 0 {
+		return Key{}, errors.New("no signing key")
+	}
+	return k.keys[len(k.keys)-1], nil
+}
+
+// verificationKey returns the key with the given ID
+func (k *Keyring) verificationKey(id string) (Key, bool) {
+	_ = k.reloadIfDue()
+
+	k.mux.RLock()
+	defer k.mux.RUnlock()
+
+	for _, key := range k.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+func readKeyringFile(path string) ([]Key, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := keyringFile{}
+	err = json.Unmarshal(content, &file)
+	if err != nil {
+		return nil, fmt.Errorf("keyring %s: %w", path, err)
+	}
+	for i := range file.Keys {
+		err = file.Keys[i].loadPrivateKey(filepath.Dir(path))
+		if err != nil {
+			return nil, fmt.Errorf("keyring %s: %w", path, err)
+		}
+	}
+	return file.Keys, nil
+}
+
+// writeKeyringFile replaces the keyring file in one step, readable only by its owner
+func writeKeyringFile(path string, keys []Key) error {
+	content, err := json.MarshalIndent(keyringFile{Keys: keys}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// RotationResult tells what RotateKeyring changed
+type RotationResult struct {
+	Added   string
+	Removed []string
+}
+
+// Rotation is how RotateKeyring makes the new signing key
+type Rotation struct {
+	// Algorithm of a generated key, HS256 if empty
+	Algorithm string
+	// PrivateKeyFile is an existing PEM file to sign with instead of generating a key
+	PrivateKeyFile string
+	// Retention is how long replaced keys still verify tokens. It should be
+	// at least the lifetime of a refresh token, so no valid token loses its key.
+	Retention time.Duration
+}
+
+// RotateKeyring adds a new signing key to the keyring file at path and removes
+// keys that have been retiring for longer than the retention.
+// Generated EdDSA and RS256 keys are saved as <kid>.pem next to the keyring file.
+// The first rotation starts the file with legacySecret as a retiring key.
+// Running servers pick up the new key within KeyringReloadInterval.
+func RotateKeyring(path, legacySecret string, rotation Rotation) (RotationResult, error) {
+	keys, err := readKeyringFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		keys = nil
+		if legacySecret != "" {
+			keys = []Key{legacyKey(legacySecret)}
+		}
+	} else if err != nil {
+		return RotationResult{}, err
+	}
+
+	now := time.Now().UTC()
+	result := RotationResult{}
+	kept := []Key{}
+	for _, key := range keys {
+		if key.RetiringSince == nil {
+			key.RetiringSince = &now
+		}
+		if now.Sub(*key.RetiringSince) > rotation.Retention {
+			result.Removed = append(result.Removed, key.ID)
+			continue
+		}
+		kept = append(kept, key)
+	}
+
+	id := make([]byte, 8)
+	_, err = rand.Read(id)
+	if err != nil {
+		return RotationResult{}, err
+	}
+	key, err := newKey(hex.EncodeToString(id), filepath.Dir(path), rotation)
+	if err != nil {
+		return RotationResult{}, err
+	}
+	key.CreatedAt = now
+	result.Added = key.ID
+
+	return result, writeKeyringFile(path, append(kept, key))
+}
+
+// newKey makes the key a rotation asks for
+func newKey(id, dir string, rotation Rotation) (Key, error) {
+	if rotation.PrivateKeyFile != "" {
+		private, err := ReadPrivateKeyFile(rotation.PrivateKeyFile)
+		if err != nil {
+			return Key{}, err
+		}
+		file, err := filepath.Abs(rotation.PrivateKeyFile)
+		if err != nil {
+			return Key{}, err
+		}
+		return Key{ID: id, Algorithm: algorithmOf(private), PrivateKeyFile: file, private: private}, nil
+	}
+
+	var private crypto.Signer
+	var err error
+	switch rotation.Algorithm {
+	case "", AlgorithmHS256:
+		secret := make([]byte, 32)
+		_, err = rand.Read(secret)
+		return Key{ID: id, Algorithm: AlgorithmHS256, Secret: secret}, err
+	case AlgorithmEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case AlgorithmRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return Key{}, fmt.Errorf("unsupported algorithm %q, use HS256, EdDSA or RS256", rotation.Algorithm)
+	}
+	if err != nil {
+		return Key{}, err
+	}
+
+	file := id + ".pem"
+	err = writePrivateKeyFile(filepath.Join(dir, file), private)
+	if err != nil {
+		return Key{}, err
+	}
+	return Key{ID: id, Algorithm: rotation.Algorithm, PrivateKeyFile: file, private: private}, nil
+}
@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// bearer returns request headers carrying the token
+func bearer(token string) http.Header {
+	return http.Header{"Authorization": []string{"Bearer " + token}}
+}
+
+// testEdDSAKey returns an EdDSA key with a freshly generated private key
+func testEdDSAKey(t *testing.T, id string) Key {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return Key{ID: id, Algorithm: AlgorithmEdDSA, private: private}
+}
+
+// keyIDOf returns the kid header of a signed token
+func keyIDOf(t *testing.T, token string) string {
+	t.Helper()
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &tokenClaims{})
+	if err != nil {
+		t.Fatalf("parse token: %v", err)
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	return kid
+}
+
+func TestKeyringSignsWithNewestKey(t *testing.T) {
+	retiring := time.Now().Add(-time.Hour)
+	old := Key{ID: "old", Secret: []byte("old secret"), RetiringSince: &retiring}
+	keys := NewKeyring(old, testEdDSAKey(t, "new"))
+
+	token, err := GetAccessToken(keys, AccessClaims{UserID: 1})
+	if err != nil {
+		t.Fatalf("GetAccessToken: %v", err)
+	}
+	if kid := keyIDOf(t, token); kid != "new" {
+		t.Errorf("token signed with key %q, want the newest key", kid)
+	}
+	claims, err := ParseAccessToken(keys, bearer(token))
+	if err != nil || claims.UserID != 1 {
+		t.Errorf("ParseAccessToken() = %+v, %v, want user 1", claims, err)
+	}
+}
+
+func TestKeyringVerifiesUntilKeyIsRemoved(t *testing.T) {
+	old := Key{ID: "old", Secret: []byte("old secret")}
+	token, err := GetAccessToken(NewKeyring(old), AccessClaims{UserID: 1})
+	if err != nil {
+		t.Fatalf("GetAccessToken: %v", err)
+	}
+
+	retiring := time.Now()
+	old.RetiringSince = &retiring
+	rotated := NewKeyring(old, testEdDSAKey(t, "new"))
+	_, err = ParseAccessToken(rotated, bearer(token))
+	if err != nil {
+		t.Errorf("token of a retiring key: %v", err)
+	}
+
+	removed := NewKeyring(testEdDSAKey(t, "new"))
+	_, err = ParseAccessToken(removed, bearer(token))
+	if err == nil {
+		t.Error("token of a removed key was accepted")
+	}
+}
+
+func TestParseTokenRejectsKeyMismatch(t *testing.T) {
+	edKey := testEdDSAKey(t, "ed")
+	hsKey := Key{ID: "hs", Secret: []byte("secret")}
+	keys := NewKeyring(hsKey, edKey)
+
+	claims := tokenClaims{RegisteredClaims: jwt.RegisteredClaims{
+		Issuer:    accessToken.Issuer,
+		Subject:   "1",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}}
+	sign := func(method jwt.SigningMethod, kid any, key any) string {
+		token := jwt.NewWithClaims(method, claims)
+		if kid != nil {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		return signed
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		// an HS256 token keyed with the public key of an EdDSA key
+		{"alg of another key", sign(jwt.SigningMethodHS256, "ed", []byte(edKey.private.Public().(ed25519.PublicKey)))},
+		{"kid of another key", sign(jwt.SigningMethodEdDSA, "hs", edKey.private)},
+		{"unknown kid", sign(jwt.SigningMethodHS256, "missing", hsKey.Secret)},
+		{"kid not a string", sign(jwt.SigningMethodHS256, 7, hsKey.Secret)},
+		// without kid a token is checked with the legacy key, which the keyring lacks
+		{"no kid", sign(jwt.SigningMethodHS256, nil, hsKey.Secret)},
+		{"alg none", sign(jwt.SigningMethodNone, "hs", jwt.UnsafeAllowNoneSignatureType)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseAccessToken(keys, bearer(tt.token))
+			if err == nil {
+				t.Error("token was accepted")
+			}
+		})
+	}
+	_, err := ParseAccessToken(keys, bearer(sign(jwt.SigningMethodHS256, "hs", hsKey.Secret)))
+	if err != nil {
+		t.Errorf("matching kid and alg: %v", err)
+	}
+}
+
+func TestLoadKeyringPicksUpRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwt_keys.json")
+	keys, err := LoadKeyring(path, "legacy secret")
+	if err != nil {
+		t.Fatalf("LoadKeyring: %v", err)
+	}
+	legacyToken, err := GetAccessToken(keys, AccessClaims{UserID: 1})
+	if err != nil {
+		t.Fatalf("GetAccessToken: %v", err)
+	}
+	if kid := keyIDOf(t, legacyToken); kid != LegacyKeyID {
+		t.Errorf("token signed with key %q before the first rotation, want %q", kid, LegacyKeyID)
+	}
+
+	result, err := RotateKeyring(path, "legacy secret", Rotation{Algorithm: AlgorithmEdDSA, Retention: time.Hour})
+	if err != nil {
+		t.Fatalf("RotateKeyring: %v", err)
+	}
+
+	// the file is not checked again before the interval is over
+	token, err := GetAccessToken(keys, AccessClaims{UserID: 1})
+	if err != nil {
+		t.Fatalf("GetAccessToken: %v", err)
+	}
+	if kid := keyIDOf(t, token); kid != LegacyKeyID {
+		t.Errorf("token signed with key %q right after the rotation, want %q until the reload", kid, LegacyKeyID)
+	}
+
+	keys.reloadInterval = 0
+	token, err = GetAccessToken(keys, AccessClaims{UserID: 1})
+	if err != nil {
+		t.Fatalf("GetAccessToken: %v", err)
+	}
+	if kid := keyIDOf(t, token); kid != result.Added {
+		t.Errorf("token signed with key %q after the reload, want the new key %q", kid, result.Added)
+	}
+	_, err = ParseAccessToken(keys, bearer(legacyToken))
+	if err != nil {
+		t.Errorf("token of the retiring legacy key: %v", err)
+	}
+}
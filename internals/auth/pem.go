@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ReadPrivateKeyFile reads an Ed25519 or RSA private key from a PEM file,
+// in PKCS #8 ("PRIVATE KEY") or for RSA also PKCS #1 ("RSA PRIVATE KEY") form
+func ReadPrivateKeyFile(path string) (crypto.Signer, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+
+	var private any
+	switch block.Type {
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	switch private := private.(type) {
+	case ed25519.PrivateKey:
+		return private, nil
+	case *rsa.PrivateKey:
+		if private.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("%s: RSA keys must have at least 2048 bits", path)
+		}
+		return private, nil
+	}
+	return nil, fmt.Errorf("%s: only Ed25519 and RSA keys are supported", path)
+}
+
+// writePrivateKeyFile saves a private key as PKCS #8 PEM, readable only by its owner
+func writePrivateKeyFile(path string, private crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = pem.Encode(file, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// algorithmOf returns the algorithm tokens are signed with using a private key
+func algorithmOf(private crypto.Signer) string {
+	switch private.(type) {
+	case ed25519.PrivateKey:
+		return AlgorithmEdDSA
+	case *rsa.PrivateKey:
+		return AlgorithmRS256
+	}
+	panic(errors.New("unsupported private key type"))
+}
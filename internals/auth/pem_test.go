@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writePEM saves a PEM block to a file in a temporary directory
+func writePEM(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key.pem")
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatalf("write PEM: %v", err)
+	}
+	return path
+}
+
+// pkcs8 encodes a private key as PKCS #8 or fails the test
+func pkcs8(t *testing.T, private any) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	return der
+}
+
+func TestReadPrivateKeyFile(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate Ed25519 key: %v", err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate RSA key: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		alg  string
+	}{
+		{"Ed25519 PKCS #8", writePEM(t, "PRIVATE KEY", pkcs8(t, edKey)), AlgorithmEdDSA},
+		{"RSA PKCS #8", writePEM(t, "PRIVATE KEY", pkcs8(t, rsaKey)), AlgorithmRS256},
+		{"RSA PKCS #1", writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)), AlgorithmRS256},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			private, err := ReadPrivateKeyFile(tt.path)
+			if err != nil {
+				t.Fatalf("ReadPrivateKeyFile: %v", err)
+			}
+			if alg := algorithmOf(private); alg != tt.alg {
+				t.Errorf("algorithm = %s, want %s", alg, tt.alg)
+			}
+		})
+	}
+}
+
+func TestReadPrivateKeyFileRejects(t *testing.T) {
+	smallRSA, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generate RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate ECDSA key: %v", err)
+	}
+	notPEM := filepath.Join(t.TempDir(), "key.pem")
+	err = os.WriteFile(notPEM, []byte("not a key"), 0600)
+	if err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"missing file", filepath.Join(t.TempDir(), "missing.pem")},
+		{"not PEM", notPEM},
+		{"public key block", writePEM(t, "PUBLIC KEY", []byte("der"))},
+		{"broken DER", writePEM(t, "PRIVATE KEY", []byte("der"))},
+		{"small RSA key", writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(smallRSA))},
+		{"ECDSA key", writePEM(t, "PRIVATE KEY", pkcs8(t, ecKey))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadPrivateKeyFile(tt.path)
+			if err == nil {
+				t.Error("ReadPrivateKeyFile accepted the file")
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// RefreshTokenLifetime is how long a refresh token can be used.
+// Every refresh replaces the token with one that lives this long again.
+const RefreshTokenLifetime = 60 * 24 * time.Hour
+
+// NewRefreshToken returns a random opaque refresh token
+// and the hash it is stored by
+func NewRefreshToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(b)
+	return token, HashRefreshToken(token), nil
+}
+
+// HashRefreshToken returns the hash a refresh token is stored by
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsLegacyRefreshToken reports whether a refresh token is a JWT
+// from before refresh tokens were opaque
+func IsLegacyRefreshToken(token string) bool {
+	return strings.Count(token, ".") == 2
+}
@@ -0,0 +1,183 @@
+package database
+
+import "fmt"
+
+const (
+	opPutUser            = "put_user"
+	opDeleteUser         = "delete_user"
+	opPutChirp           = "put_chirp"
+	opDeleteChirp        = "delete_chirp"
+	opPutRevokedToken    = "put_revoked_token"
+	opDeleteRevokedToken = "delete_revoked_token"
+	opPutRefreshToken    = "put_refresh_token"
+	opDeleteRefreshToken = "delete_refresh_token"
+	opPutSession         = "put_session"
+	opDeleteSession      = "delete_session"
+)
+
+// change is a single record level modification of a DBStructure.
+// Applying the same change twice gives the same result.
+type change struct {
+	Op           string        `json:"op"`
+	ID           int           `json:"id,omitempty"`
+	Token        string        `json:"token,omitempty"`
+	User         *User         `json:"user,omitempty"`
+	Chirp        *Chirp        `json:"chirp,omitempty"`
+	RevokedToken *RevokedToken `json:"revoked_token,omitempty"`
+	RefreshToken *RefreshToken `json:"refresh_token,omitempty"`
+	SessionID    string        `json:"session_id,omitempty"`
+	Session      *Session      `json:"session,omitempty"`
+}
+
+func putUser(user User) change {
+	return change{Op: opPutUser, User: &user}
+}
+
+func deleteUser(id int) change {
+	return change{Op: opDeleteUser, ID: id}
+}
+
+func putChirp(chirp Chirp) change {
+	return change{Op: opPutChirp, Chirp: &chirp}
+}
+
+func deleteChirp(id int) change {
+	return change{Op: opDeleteChirp, ID: id}
+}
+
+func putRevokedToken(token RevokedToken) change {
+	return change{Op: opPutRevokedToken, RevokedToken: &token}
+}
+
+func deleteRevokedToken(token string) change {
+	return change{Op: opDeleteRevokedToken, Token: token}
+}
+
+func putRefreshToken(token RefreshToken) change {
+	return change{Op: opPutRefreshToken, RefreshToken: &token}
+}
+
+func deleteRefreshToken(hash string) change {
+	return change{Op: opDeleteRefreshToken, Token: hash}
+}
+
+func putSession(session Session) change {
+	return change{Op: opPutSession, Session: &session}
+}
+
+func deleteSession(id string) change {
+	return change{Op: opDeleteSession, SessionID: id}
+}
+
+// apply replays a change onto the structure, updating its indexes if built,
+// and returns the change that undoes it
+func (s *DBStructure) apply(c change) (change, error) {
+	switch c.Op {
+	case opPutUser:
+		if c.User == nil {
+			return change{}, fmt.Errorf("%s: missing user", c.Op)
+		}
+		old, exists := s.Users[c.User.ID]
+		s.Users[c.User.ID] = *c.User
+		s.advanceID(collectionUsers, c.User.ID)
+		if s.index != nil {
+			if exists {
+				s.index.removeUser(old)
+			}
+			s.index.addUser(*c.User)
+		}
+		if exists {
+			return putUser(old), nil
+		}
+		return deleteUser(c.User.ID), nil
+	case opDeleteUser:
+		old, exists := s.Users[c.ID]
+		delete(s.Users, c.ID)
+		if exists && s.index != nil {
+			s.index.removeUser(old)
+		}
+		if exists {
+			return putUser(old), nil
+		}
+		return deleteUser(c.ID), nil
+	case opPutChirp:
+		if c.Chirp == nil {
+			return change{}, fmt.Errorf("%s: missing chirp", c.Op)
+		}
+		old, exists := s.Chirps[c.Chirp.Id]
+		s.Chirps[c.Chirp.Id] = *c.Chirp
+		s.advanceID(collectionChirps, c.Chirp.Id)
+		if s.index != nil {
+			if exists {
+				s.index.removeChirp(old)
+			}
+			s.index.addChirp(*c.Chirp)
+		}
+		if exists {
+			return putChirp(old), nil
+		}
+		return deleteChirp(c.Chirp.Id), nil
+	case opDeleteChirp:
+		old, exists := s.Chirps[c.ID]
+		delete(s.Chirps, c.ID)
+		if exists && s.index != nil {
+			s.index.removeChirp(old)
+		}
+		if exists {
+			return putChirp(old), nil
+		}
+		return deleteChirp(c.ID), nil
+	case opPutRevokedToken:
+		if c.RevokedToken == nil {
+			return change{}, fmt.Errorf("%s: missing revoked token", c.Op)
+		}
+		old, exists := s.RevokedTokens[c.RevokedToken.Token]
+		s.RevokedTokens[c.RevokedToken.Token] = *c.RevokedToken
+		if exists {
+			return putRevokedToken(old), nil
+		}
+		return deleteRevokedToken(c.RevokedToken.Token), nil
+	case opDeleteRevokedToken:
+		old, exists := s.RevokedTokens[c.Token]
+		delete(s.RevokedTokens, c.Token)
+		if exists {
+			return putRevokedToken(old), nil
+		}
+		return deleteRevokedToken(c.Token), nil
+	case opPutRefreshToken:
+		if c.RefreshToken == nil {
+			return change{}, fmt.Errorf("%s: missing refresh token", c.Op)
+		}
+		old, exists := s.RefreshTokens[c.RefreshToken.Hash]
+		s.RefreshTokens[c.RefreshToken.Hash] = *c.RefreshToken
+		if exists {
+			return putRefreshToken(old), nil
+		}
+		return deleteRefreshToken(c.RefreshToken.Hash), nil
+	case opDeleteRefreshToken:
+		old, exists := s.RefreshTokens[c.Token]
+		delete(s.RefreshTokens, c.Token)
+		if exists {
+			return putRefreshToken(old), nil
+		}
+		return deleteRefreshToken(c.Token), nil
+	case opPutSession:
+		if c.Session == nil {
+			return change{}, fmt.Errorf("%s: missing session", c.Op)
+		}
+		old, exists := s.Sessions[c.Session.ID]
+		s.Sessions[c.Session.ID] = *c.Session
+		if exists {
+			return putSession(old), nil
+		}
+		return deleteSession(c.Session.ID), nil
+	case opDeleteSession:
+		old, exists := s.Sessions[c.SessionID]
+		delete(s.Sessions, c.SessionID)
+		if exists {
+			return putSession(old), nil
+		}
+		return deleteSession(c.SessionID), nil
+	}
+	return change{}, fmt.Errorf("unknown change %q", c.Op)
+}
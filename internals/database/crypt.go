@@ -0,0 +1,83 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// Name of the cipher recorded in encrypted database files
+const encryptionAES256GCM = "aes-256-gcm"
+
+const encryptionKeySize = 32
+
+var (
+	ErrKeyRequired = errors.New("database is encrypted but no encryption key was given")
+	ErrWrongKey    = errors.New("database could not be decrypted, the encryption key is wrong")
+	// ErrNotEncrypted is returned for unencrypted data read with an encryption key,
+	// which could have been put in place of the encrypted files
+	ErrNotEncrypted = errors.New("database is not encrypted but an encryption key was given, encrypt it with RotateKey first")
+	// ErrRotationIncomplete is returned by RotateKey when the database was written
+	// with the new key but something encrypted with the old key could not be replaced
+	ErrRotationIncomplete = errors.New("database is encrypted with the new key but the rotation did not finish")
+)
+
+// ParseEncryptionKey decodes a base64 encoded 256 bit key
+func ParseEncryptionKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key is not valid base64: %w", err)
+	}
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", encryptionKeySize, len(key))
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts and authenticates plaintext under key with a random nonce
+func seal(key, plaintext []byte) (nonce, ciphertext []byte, err error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce = make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nonce, gcm.Seal(nil, nonce, plaintext, nil), nil
+}
+
+// unseal decrypts what seal encrypted, failing with ErrWrongKey
+// when the key does not match
+func unseal(key, nonce, ciphertext []byte) ([]byte, error) {
+	if key == nil {
+		return nil, ErrKeyRequired
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,178 @@
+package database
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	testKey      = bytes.Repeat([]byte{1}, encryptionKeySize)
+	testOtherKey = bytes.Repeat([]byte{2}, encryptionKeySize)
+)
+
+func TestParseEncryptionKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+		wantErr bool
+	}{
+		{"valid", base64.StdEncoding.EncodeToString(testKey), false},
+		{"not base64", "not base64!", true},
+		{"too short", base64.StdEncoding.EncodeToString(testKey[:16]), true},
+		{"empty", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ParseEncryptionKey(tt.encoded)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseEncryptionKey(%q) error = %v, want error %v", tt.encoded, err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(key, testKey) {
+				t.Errorf("ParseEncryptionKey(%q) = %x, want %x", tt.encoded, key, testKey)
+			}
+		})
+	}
+}
+
+// openers open the file and log backends at path with the given options
+var openers = map[string]func(path string, opts Options) (*DB, error){
+	"json": NewDBWithOptions,
+	"wal":  NewLogDBWithOptions,
+}
+
+func TestEncryptedDBNeedsItsKey(t *testing.T) {
+	for name, open := range openers {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json")
+			db, err := open(path, Options{EncryptionKey: testKey})
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			mustCreateUser(t, db, "a@example.com")
+			db.Close()
+
+			tests := []struct {
+				key  []byte
+				want error
+			}{
+				{nil, ErrKeyRequired},
+				{testOtherKey, ErrWrongKey},
+			}
+			for _, tt := range tests {
+				_, err = open(path, Options{EncryptionKey: tt.key})
+				if !errors.Is(err, tt.want) {
+					t.Errorf("open with key %x = %v, want %v", tt.key, err, tt.want)
+				}
+			}
+
+			db, err = open(path, Options{EncryptionKey: testKey})
+			if err != nil {
+				t.Fatalf("open with the key: %v", err)
+			}
+			defer db.Close()
+			if _, err := db.GetUserByEmail("a@example.com"); err != nil {
+				t.Errorf("GetUserByEmail: %v", err)
+			}
+		})
+	}
+}
+
+func TestUnencryptedDBRejectsKey(t *testing.T) {
+	for name, open := range openers {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json")
+			db, err := open(path, Options{})
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			mustCreateUser(t, db, "a@example.com")
+			// the json backend only has a file after a write
+			db.Close()
+
+			_, err = open(path, Options{EncryptionKey: testKey})
+			if !errors.Is(err, ErrNotEncrypted) {
+				t.Fatalf("open unencrypted data with a key = %v, want ErrNotEncrypted", err)
+			}
+		})
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	for name, open := range openers {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json")
+			db, err := open(path, Options{})
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			// enough writes for every backup generation of the json backend
+			for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+				mustCreateUser(t, db, email)
+			}
+
+			// unencrypted -> testKey -> testOtherKey
+			for _, key := range [][]byte{testKey, testOtherKey} {
+				err = db.RotateKey(key)
+				if err != nil {
+					t.Fatalf("RotateKey: %v", err)
+				}
+			}
+			mustCreateUser(t, db, "d@example.com")
+			db.Close()
+
+			_, err = open(path, Options{EncryptionKey: testKey})
+			if !errors.Is(err, ErrWrongKey) {
+				t.Errorf("open with the rotated out key = %v, want ErrWrongKey", err)
+			}
+			db, err = open(path, Options{EncryptionKey: testOtherKey})
+			if err != nil {
+				t.Fatalf("open with the new key: %v", err)
+			}
+			defer db.Close()
+			for _, email := range []string{"a@example.com", "d@example.com"} {
+				if _, err := db.GetUserByEmail(email); err != nil {
+					t.Errorf("GetUserByEmail(%q): %v", email, err)
+				}
+			}
+
+			if name != "json" {
+				return
+			}
+			for n := 1; n <= backupGenerations; n++ {
+				_, err = readDBFile(backupPath(path, n), testOtherKey)
+				if err != nil {
+					t.Errorf("backup %d with the new key: %v", n, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRotateKeyKeepsNewKeyOnceSnapshotIsWritten(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewLogDBWithOptions(path, Options{EncryptionKey: testKey})
+	if err != nil {
+		t.Fatalf("NewLogDBWithOptions: %v", err)
+	}
+	defer db.Close()
+	mustCreateUser(t, db, "a@example.com")
+
+	// the snapshot can be written, but the log can't be emptied
+	db.storage.(*logStorage).log.Close()
+	err = db.RotateKey(testOtherKey)
+	if !errors.Is(err, ErrRotationIncomplete) {
+		t.Fatalf("RotateKey() = %v, want ErrRotationIncomplete", err)
+	}
+
+	if !bytes.Equal(db.encryptionKey, testOtherKey) || !bytes.Equal(db.storage.(*logStorage).key, testOtherKey) {
+		t.Error("DB went back to the old key after the snapshot was written with the new one")
+	}
+	_, err = readDBFile(path, testOtherKey)
+	if err != nil {
+		t.Errorf("snapshot with the new key: %v", err)
+	}
+}
@@ -1,303 +1,478 @@
-package database
-
-import (
-	"encoding/json"
-	"errors"
-	"os"
-	"sync"
-	"time"
-)
-
-var (
-	ErrAlreadyExists = errors.New("already exists")
-	ErrNotExists     = errors.New("not exists")
-)
-
-type Chirp struct {
-	Id       int    `json:"id"`
-	AuthorID int    `json:"author_id"`
-	Body     string `json:"body"`
-}
-
-type User struct {
-	ID             int    `json:"id"`
-	Email          string `json:"email"`
-	HashedPassword string `json:"password"`
-	IsChirpyRed    bool   `json:"is_chirpy_red"`
-}
-
-type DB struct {
-	path string
-	mux  *sync.RWMutex
-}
-
-type DBStructure struct {
-	Chirps        map[int]Chirp           `json:"chirps"`
-	ChirpLastID   int                     `json:"chirp_last_id"`
-	Users         map[int]User            `json:"users"`
-	RevokedTokens map[string]RevokedToken `json:"revoked_tokens"`
-}
-
-type RevokedToken struct {
-	Token     string    `json:"token"`
-	RevokedAt time.Time `json:"revoked_at"`
-}
-
-// NewDB creates a new database connection
-// and creates the database file if it doesn't exist
-func NewDB(path string) (*DB, error) {
-	db := &DB{path: path, mux: &sync.RWMutex{}}
-	err := db.ensureDB()
-	if err != nil {
-		return &DB{}, err
-	}
-	return db, nil
-}
-
-func (db *DB) CreateUser(email string, password string) (User, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
-	data, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-
-	for _, user := range data.Users {
-		if user.Email == email {
-			return User{}, ErrAlreadyExists
-		}
-	}
-
-	id := len(data.Users) + 1
-	user := User{
-		ID:             id,
-		Email:          email,
-		HashedPassword: password,
-		IsChirpyRed:    false,
-	}
-
-	data.Users[id] = user
-	err = db.writeDB(data)
-	if err != nil {
-		return User{}, err
-	}
-
-	return user, nil
-}
-
-func (db *DB) GetUserByEmail(email string) (User, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-
-	for _, user := range dbStructure.Users {
-		if user.Email == email {
-			return user, nil
-		}
-	}
-
-	return User{}, errors.New("user not found")
-}
-
-func (db *DB) UpdateUser(id int, email, hashedPassword string) (User, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-
-	for dbID, user := range dbStructure.Users {
-		if user.ID == id {
-			user.Email = email
-			user.HashedPassword = hashedPassword
-
-			dbStructure.Users[dbID] = user
-
-			return user, db.writeDB(dbStructure)
-		}
-	}
-
-	return User{}, errors.New("user not found")
-}
-
-func (db *DB) PaintUserRed(userID int) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return err
-	}
-
-	user, exists := dbStructure.Users[userID]
-	if !exists {
-		return ErrNotExists
-	}
-
-	user.IsChirpyRed = true
-	dbStructure.Users[userID] = user
-
-	return db.writeDB(dbStructure)
-}
-
-// CreateChirp creates a new chirp and saves it to disk
-func (db *DB) CreateChirp(authorID int, body string) (Chirp, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return Chirp{}, err
-	}
-
-	dbStructure.ChirpLastID++
-	id := dbStructure.ChirpLastID
-	chirp := Chirp{
-		Id:       id,
-		AuthorID: authorID,
-		Body:     body,
-	}
-
-	dbStructure.Chirps[id] = chirp
-	err = db.writeDB(dbStructure)
-	if err != nil {
-		return Chirp{}, err
-	}
-
-	return chirp, nil
-}
-
-func (db *DB) DeleteChirp(id int) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return err
-	}
-
-	delete(dbStructure.Chirps, id)
-
-	return db.writeDB(dbStructure)
-}
-
-// GetChirps returns all chirps in the database
-func (db *DB) GetChirps() ([]Chirp, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return []Chirp{}, err
-	}
-
-	chirps := make([]Chirp, 0, len(dbStructure.Chirps))
-	for _, chirp := range dbStructure.Chirps {
-		chirps = append(chirps, chirp)
-	}
-
-	return chirps, nil
-}
-
-// GetChirp returns a single chirp by ID
-func (db *DB) GetChirp(id int) (Chirp, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return Chirp{}, err
-	}
-
-	chirp, exists := dbStructure.Chirps[id]
-	if !exists {
-		return Chirp{}, errors.New("chirp does not exist")
-	}
-
-	return chirp, nil
-}
-
-// ensureDB creates a new database file if it doesn't exist
-func (db *DB) ensureDB() error {
-	if _, err := os.Stat(db.path); !errors.Is(err, os.ErrNotExist) {
-		return nil
-	}
-
-	emptyDB := DBStructure{
-		Chirps:        map[int]Chirp{},
-		ChirpLastID:   0,
-		Users:         map[int]User{},
-		RevokedTokens: map[string]RevokedToken{},
-	}
-	db.writeDB(emptyDB)
-	return nil
-}
-
-func (db *DB) AddRevokedToken(tokenString string) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return err
-	}
-
-	token := RevokedToken{
-		Token:     tokenString,
-		RevokedAt: time.Now().UTC(),
-	}
-	dbStructure.RevokedTokens[tokenString] = token
-
-	return db.writeDB(dbStructure)
-}
-
-func (db *DB) IsTokenRevoked(tokenString string) (bool, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return false, err
-	}
-
-	_, exists := dbStructure.RevokedTokens[tokenString]
-	if exists {
-		return true, nil
-	}
-
-	return false, nil
-}
-
-// loadDB reads the database file into memory
-func (db *DB) loadDB() (DBStructure, error) {
-	data := DBStructure{}
-
-	file, err := os.ReadFile(db.path)
-	if err != nil {
-		return data, err
-	}
-
-	err = json.Unmarshal(file, &data)
-	if err != nil {
-		return data, err
-	}
-
-	return data, nil
-}
-
-// writeDB writes the database file to disk
-func (db *DB) writeDB(dbStructure DBStructure) error {
-	jsonData, err := json.Marshal(dbStructure)
-	if err != nil {
-		return err
-	}
-
-	return os.WriteFile(db.path, jsonData, 0600)
-}
+package database
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAlreadyExists = errors.New("already exists")
+	ErrNotExists     = errors.New("not exists")
+)
+
+type Chirp struct {
+	Id        int       `json:"id"`
+	AuthorID  int       `json:"author_id"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// DeletedAt is set on deleted chirps until they are purged
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Deleted reports whether the chirp is a tombstone
+func (c Chirp) Deleted() bool {
+	return c.DeletedAt != nil
+}
+
+type User struct {
+	ID             int       `json:"id"`
+	Email          string    `json:"email"`
+	HashedPassword string    `json:"password"`
+	IsChirpyRed    bool      `json:"is_chirpy_red"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	// TokenVersion is bumped to reject all access tokens issued before
+	TokenVersion int `json:"token_version"`
+	// DeletedAt is set on deleted users until they are purged
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Deleted reports whether the user is a tombstone
+func (u User) Deleted() bool {
+	return u.DeletedAt != nil
+}
+
+type DB struct {
+	storage        storage
+	mux            *sync.RWMutex
+	data           DBStructure
+	reloadOnChange bool
+	recovered      error
+	migrated       []string
+	fileLock       *fileLock
+	encryptionKey  []byte
+	feed           *feed
+}
+
+type DBStructure struct {
+	Version       int                     `json:"version"`
+	Chirps        map[int]Chirp           `json:"chirps"`
+	ChirpLastID   int                     `json:"chirp_last_id"`
+	Users         map[int]User            `json:"users"`
+	UserLastID    int                     `json:"user_last_id"`
+	RevokedTokens map[string]RevokedToken `json:"revoked_tokens"`
+	RefreshTokens map[string]RefreshToken `json:"refresh_tokens"`
+	Sessions      map[string]Session      `json:"sessions"`
+
+	index *indexes
+	// notes of the running migration about what it changed
+	notes []string
+}
+
+// RevokedToken is a denied token: a refresh token from before they were opaque,
+// or the jti of an access token
+type RevokedToken struct {
+	Token     string    `json:"token"`
+	RevokedAt time.Time `json:"revoked_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Options tune how a DB works with its file
+type Options struct {
+	// ReloadOnChange checks the file before every operation
+	// and reloads it when it was edited by someone else
+	ReloadOnChange bool
+	// Lock keeps other processes from opening the same files while the DB is open
+	Lock LockMode
+	// EncryptionKey encrypts the files with AES-256-GCM, see ParseEncryptionKey.
+	// Unencrypted files are rejected with ErrNotEncrypted; to encrypt existing
+	// files and backups, open them without a key and use RotateKey.
+	EncryptionKey []byte
+}
+
+// NewDB creates a new database connection
+// and creates the database file if it doesn't exist
+func NewDB(path string) (*DB, error) {
+	return NewDBWithOptions(path, Options{})
+}
+
+// NewDBWithOptions creates a new database connection like NewDB
+// with non-default options
+func NewDBWithOptions(path string, opts Options) (*DB, error) {
+	lock, err := acquireLock(path, opts.Lock)
+	if err != nil {
+		return &DB{}, err
+	}
+
+	fs := &fileStorage{path: path, key: opts.EncryptionKey}
+	err = fs.ensureDB()
+	if err != nil {
+		lock.release()
+		return &DB{}, err
+	}
+	db, err := newDB(fs, opts)
+	if err != nil {
+		lock.release()
+		return db, err
+	}
+	db.recovered = fs.recovered
+	db.fileLock = lock
+	db.encryptionKey = opts.EncryptionKey
+	return db, nil
+}
+
+// Recovered returns why the database file was replaced by a backup
+// generation when the DB was opened (a *CorruptError or a missing file), or nil.
+func (db *DB) Recovered() error {
+	return db.recovered
+}
+
+// Migrated returns the descriptions of the migrations run when the DB was opened
+func (db *DB) Migrated() []string {
+	return db.migrated
+}
+
+// NewMemoryDB creates a new database that lives only in memory.
+// Useful for tests and throwaway instances.
+func NewMemoryDB() *DB {
+	db, _ := newDB(memoryStorage{}, Options{})
+	return db
+}
+
+// newDB loads the data from storage, migrates and checks it and keeps it in memory.
+// Reads are served from memory, writes go through to the storage.
+func newDB(s storage, opts Options) (*DB, error) {
+	data, err := s.load()
+	if err != nil {
+		return &DB{}, err
+	}
+	migrated, err := migrateDB(s, &data)
+	if err != nil {
+		return &DB{}, err
+	}
+	err = data.checkIntegrity()
+	if err != nil {
+		return &DB{}, err
+	}
+	data.buildIndexes()
+	return &DB{
+		storage:        s,
+		mux:            &sync.RWMutex{},
+		data:           data,
+		reloadOnChange: opts.ReloadOnChange,
+		migrated:       migrated,
+		feed:           newFeed(),
+	}, nil
+}
+
+// Close releases the files of the DB and ends all subscriptions.
+// The DB must not be used afterwards.
+func (db *DB) Close() error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	db.feed.endAll(nil)
+
+	err := db.storage.close()
+	if lockErr := db.fileLock.release(); err == nil {
+		err = lockErr
+	}
+	db.fileLock = nil
+	return err
+}
+
+// RotateKey re-encrypts the database files with newKey, or decrypts them if newKey is nil.
+// The DB keeps using newKey for all later writes, also when the rotation fails
+// with ErrRotationIncomplete after the data was written with it.
+func (db *DB) RotateKey(newKey []byte) error {
+	err := db.lock()
+	if err != nil {
+		return err
+	}
+	defer db.mux.Unlock()
+
+	ks, ok := db.storage.(keyedStorage)
+	if !ok {
+		return errors.New("database storage does not support encryption")
+	}
+	err = ks.rotateKey(db.data, newKey)
+	if err == nil || errors.Is(err, ErrRotationIncomplete) {
+		db.encryptionKey = newKey
+	}
+	return err
+}
+
+func newDBStructure() DBStructure {
+	return DBStructure{
+		Version:       schemaVersion,
+		Chirps:        map[int]Chirp{},
+		ChirpLastID:   0,
+		Users:         map[int]User{},
+		UserLastID:    0,
+		RevokedTokens: map[string]RevokedToken{},
+		RefreshTokens: map[string]RefreshToken{},
+		Sessions:      map[string]Session{},
+	}
+}
+
+func (db *DB) CreateUser(email string, password string) (user User, err error) {
+	err = db.Update(func(tx *Tx) error {
+		user, err = tx.CreateUser(email, password)
+		return err
+	})
+	return user, err
+}
+
+func (db *DB) GetUserByEmail(email string) (user User, err error) {
+	err = db.View(func(tx *Tx) error {
+		user, err = tx.GetUserByEmail(email)
+		return err
+	})
+	return user, err
+}
+
+func (db *DB) GetUser(id int) (user User, err error) {
+	err = db.View(func(tx *Tx) error {
+		user, err = tx.GetUser(id)
+		return err
+	})
+	return user, err
+}
+
+// UpdateUser changes the email and password of a user.
+// A new password hash bumps the user's TokenVersion and revokes every session
+// of the user except keepSession, the one the change was made with.
+func (db *DB) UpdateUser(id int, email, hashedPassword, keepSession string) (user User, err error) {
+	err = db.Update(func(tx *Tx) error {
+		user, err = tx.UpdateUser(id, email, hashedPassword, keepSession)
+		return err
+	})
+	return user, err
+}
+
+func (db *DB) PaintUserRed(userID int) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.PaintUserRed(userID)
+	})
+}
+
+// DeleteUser marks a user as deleted, it is purged by PurgeDeletedUsers later.
+// The user is logged out everywhere and its chirps are deleted with it.
+// Its email stays taken until the user is purged.
+func (db *DB) DeleteUser(id int) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.DeleteUser(id)
+	})
+}
+
+// GetDeletedUserByEmail returns the deleted user with email, to check who restores it.
+// Returns ErrNotExists or ErrNotDeleted otherwise.
+func (db *DB) GetDeletedUserByEmail(email string) (user User, err error) {
+	err = db.View(func(tx *Tx) error {
+		user, err = tx.GetDeletedUserByEmail(email)
+		return err
+	})
+	return user, err
+}
+
+// RestoreUser undeletes a user that was deleted after deletedAfter,
+// together with the chirps that were deleted with it.
+// Returns ErrNotExists, ErrNotDeleted or ErrRestoreExpired otherwise.
+func (db *DB) RestoreUser(id int, deletedAfter time.Time) (user User, err error) {
+	err = db.Update(func(tx *Tx) error {
+		user, err = tx.RestoreUser(id, deletedAfter)
+		return err
+	})
+	return user, err
+}
+
+// PurgeDeletedUsers removes users that were deleted before the given time for good,
+// with their chirps and sessions. Returns how many users were removed.
+func (db *DB) PurgeDeletedUsers(before time.Time) (purged int, err error) {
+	err = db.Update(func(tx *Tx) error {
+		purged, err = tx.PurgeDeletedUsers(before)
+		return err
+	})
+	return purged, err
+}
+
+// CreateChirp creates a new chirp and saves it to disk
+func (db *DB) CreateChirp(authorID int, body string) (chirp Chirp, err error) {
+	err = db.Update(func(tx *Tx) error {
+		chirp, err = tx.CreateChirp(authorID, body)
+		return err
+	})
+	return chirp, err
+}
+
+// DeleteChirp marks a chirp as deleted, it is purged by PurgeDeletedChirps later
+func (db *DB) DeleteChirp(id int) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.DeleteChirp(id)
+	})
+}
+
+// DeleteChirpByAuthor deletes a chirp only if it belongs to authorID.
+// Returns ErrNotExists or ErrNotOwner otherwise.
+func (db *DB) DeleteChirpByAuthor(id, authorID int) error {
+	return db.Update(func(tx *Tx) error {
+		chirp, err := tx.GetChirp(id)
+		if err != nil {
+			return ErrNotExists
+		}
+		if chirp.AuthorID != authorID {
+			return ErrNotOwner
+		}
+		return tx.DeleteChirp(id)
+	})
+}
+
+// RestoreChirpByAuthor undeletes a chirp of authorID that was deleted after deletedAfter.
+// Returns ErrNotExists, ErrNotOwner, ErrNotDeleted or ErrRestoreExpired otherwise.
+func (db *DB) RestoreChirpByAuthor(id, authorID int, deletedAfter time.Time) (chirp Chirp, err error) {
+	err = db.Update(func(tx *Tx) error {
+		chirp, err = tx.RestoreChirpByAuthor(id, authorID, deletedAfter)
+		return err
+	})
+	return chirp, err
+}
+
+// PurgeDeletedChirps removes chirps that were deleted before the given time for good.
+// Returns how many were removed.
+func (db *DB) PurgeDeletedChirps(before time.Time) (purged int, err error) {
+	err = db.Update(func(tx *Tx) error {
+		purged, err = tx.PurgeDeletedChirps(before)
+		return err
+	})
+	return purged, err
+}
+
+// GetChirps returns all chirps in the database
+func (db *DB) GetChirps() (chirps []Chirp, err error) {
+	err = db.View(func(tx *Tx) error {
+		chirps, err = tx.GetChirps()
+		return err
+	})
+	return chirps, err
+}
+
+// GetChirpsByAuthor returns all chirps of one author
+func (db *DB) GetChirpsByAuthor(authorID int) (chirps []Chirp, err error) {
+	err = db.View(func(tx *Tx) error {
+		chirps, err = tx.GetChirpsByAuthor(authorID)
+		return err
+	})
+	return chirps, err
+}
+
+// GetChirp returns a single chirp by ID
+func (db *DB) GetChirp(id int) (chirp Chirp, err error) {
+	err = db.View(func(tx *Tx) error {
+		chirp, err = tx.GetChirp(id)
+		return err
+	})
+	return chirp, err
+}
+
+// AddRevokedToken stores a revoked token until it expires
+func (db *DB) AddRevokedToken(tokenString string, expiresAt time.Time) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.AddRevokedToken(tokenString, expiresAt)
+	})
+}
+
+func (db *DB) IsTokenRevoked(tokenString string) (revoked bool, err error) {
+	err = db.View(func(tx *Tx) error {
+		revoked, err = tx.IsTokenRevoked(tokenString)
+		return err
+	})
+	return revoked, err
+}
+
+// lock takes the write lock, reloading the data first if needed
+func (db *DB) lock() error {
+	db.mux.Lock()
+	if !db.reloadOnChange {
+		return nil
+	}
+
+	err := db.reloadIfChanged()
+	if err != nil {
+		db.mux.Unlock()
+		return err
+	}
+	return nil
+}
+
+// rlock takes the read lock, reloading the data first if needed
+func (db *DB) rlock() error {
+	if !db.reloadOnChange {
+		db.mux.RLock()
+		return nil
+	}
+
+	db.mux.RLock()
+	changed, err := db.storageChanged()
+	db.mux.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		db.mux.Lock()
+		err = db.reloadIfChanged()
+		db.mux.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	db.mux.RLock()
+	return nil
+}
+
+// reloadIfChanged replaces the data in memory with what is in storage
+// in case someone else changed it. Caller must hold the write lock.
+func (db *DB) reloadIfChanged() error {
+	changed, err := db.storageChanged()
+	if err != nil || !changed {
+		return err
+	}
+
+	data, err := db.storage.load()
+	if err != nil {
+		return err
+	}
+	_, err = migrateDB(db.storage, &data)
+	if err != nil {
+		return err
+	}
+	err = data.checkIntegrity()
+	if err != nil {
+		return err
+	}
+	data.buildIndexes()
+	db.data = data
+	db.feed.endAll(ErrDataReplaced)
+	return nil
+}
+
+func (db *DB) storageChanged() (bool, error) {
+	ws, ok := db.storage.(watchedStorage)
+	if !ok {
+		return false, nil
+	}
+	return ws.changed()
+}
+
+// PruneRevokedTokens deletes revoked tokens that expired before the given time.
+// Returns how many were deleted.
+func (db *DB) PruneRevokedTokens(before time.Time) (pruned int, err error) {
+	err = db.Update(func(tx *Tx) error {
+		pruned, err = tx.PruneRevokedTokens(before)
+		return err
+	})
+	return pruned, err
+}
@@ -0,0 +1,161 @@
+package database
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrSubscriberTooSlow ends a subscription whose buffer was full when an event was published
+	ErrSubscriberTooSlow = errors.New("subscriber fell behind, events were dropped")
+	// ErrDataReplaced ends all subscriptions when the data is replaced as a whole,
+	// by a snapshot restore or a reload of a file edited by someone else
+	ErrDataReplaced = errors.New("data was replaced")
+)
+
+// Event is a change to the data of a DB.
+// It is one of ChirpCreated, ChirpDeleted, ChirpRestored, UserCreated, UserUpdated,
+// UserDeleted, UserRestored or TokenRevoked.
+type Event interface {
+	isEvent()
+}
+
+type ChirpCreated struct {
+	Chirp Chirp
+}
+
+// ChirpDeleted is published when a chirp is deleted, not when its tombstone is purged
+type ChirpDeleted struct {
+	Chirp Chirp
+}
+
+type ChirpRestored struct {
+	Chirp Chirp
+}
+
+type UserCreated struct {
+	User User
+}
+
+type UserUpdated struct {
+	User User
+}
+
+// UserDeleted is published when a user is deleted, not when its tombstone is purged
+type UserDeleted struct {
+	User User
+}
+
+type UserRestored struct {
+	User User
+}
+
+type TokenRevoked struct {
+	Token RevokedToken
+}
+
+func (ChirpCreated) isEvent()  {}
+func (ChirpDeleted) isEvent()  {}
+func (ChirpRestored) isEvent() {}
+func (UserCreated) isEvent()   {}
+func (UserUpdated) isEvent()   {}
+func (UserDeleted) isEvent()   {}
+func (UserRestored) isEvent()  {}
+func (TokenRevoked) isEvent()  {}
+
+// Subscription receives the events of a DB in the order they happened
+type Subscription struct {
+	events chan Event
+	feed   *feed
+	err    error
+}
+
+// Events returns the channel events are delivered on.
+// It is closed when the subscription ends, see Err.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Err returns why the subscription ended: nil after Close or when the DB was closed,
+// ErrSubscriberTooSlow or ErrDataReplaced when the subscriber has to catch up by reading the DB.
+func (s *Subscription) Err() error {
+	s.feed.mux.Lock()
+	defer s.feed.mux.Unlock()
+	return s.err
+}
+
+// Close ends the subscription
+func (s *Subscription) Close() {
+	s.feed.mux.Lock()
+	defer s.feed.mux.Unlock()
+	s.feed.end(s, nil)
+}
+
+// feed hands published events to the subscriptions of a DB
+type feed struct {
+	mux  sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+func newFeed() *feed {
+	return &feed{subs: map[*Subscription]struct{}{}}
+}
+
+func (f *feed) subscribe(buffer int) *Subscription {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	s := &Subscription{events: make(chan Event, buffer), feed: f}
+	f.subs[s] = struct{}{}
+	return s
+}
+
+// publish delivers events to every subscription without blocking.
+// Subscriptions that can't take all of them are ended with ErrSubscriberTooSlow.
+func (f *feed) publish(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	for s := range f.subs {
+	deliver:
+		for _, event := range events {
+			select {
+			case s.events <- event:
+			default:
+				f.end(s, ErrSubscriberTooSlow)
+				break deliver
+			}
+		}
+	}
+}
+
+// endAll ends every subscription with err
+func (f *feed) endAll(err error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	for s := range f.subs {
+		f.end(s, err)
+	}
+}
+
+// end removes a subscription and closes its channel. Caller must hold the lock.
+func (f *feed) end(s *Subscription, err error) {
+	if _, ok := f.subs[s]; !ok {
+		return
+	}
+	delete(f.subs, s)
+	s.err = err
+	close(s.events)
+}
+
+// Subscribe starts receiving the events of writes made after this call,
+// as soon as they are written to storage. buffer is how many events can wait
+// for the subscriber before it is considered too slow.
+func (db *DB) Subscribe(buffer int) *Subscription {
+	return db.feed.subscribe(buffer)
+}
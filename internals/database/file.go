@@ -0,0 +1,245 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Number of previous versions of the database file kept next to it
+// as path.1 (newest) to path.N (oldest)
+const backupGenerations = 2
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// CorruptError reports a database file that could not be read back
+// because it is truncated, not valid JSON or fails its checksum
+type CorruptError struct {
+	Path string
+	Err  error
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("database file %s is corrupt: %v", e.Path, e.Err)
+}
+
+func (e *CorruptError) Unwrap() error {
+	return e.Err
+}
+
+// dbFile is the layout of a database file on disk.
+// Checksum is the hex SHA-256 of the exact bytes of Data.
+// Data is the structure itself, or when Encryption is set,
+// the base64 encoded ciphertext of it sealed with Nonce.
+type dbFile struct {
+	Checksum   string          `json:"checksum"`
+	Encryption string          `json:"encryption,omitempty"`
+	Nonce      []byte          `json:"nonce,omitempty"`
+	Data       json.RawMessage `json:"data"`
+}
+
+// encodeDBFile serializes the structure together with its checksum,
+// encrypting it if a key is given
+func encodeDBFile(dbStructure DBStructure, key []byte) ([]byte, error) {
+	data, err := json.Marshal(dbStructure)
+	if err != nil {
+		return nil, err
+	}
+
+	file := dbFile{}
+	if key != nil {
+		nonce, ciphertext, err := seal(key, data)
+		if err != nil {
+			return nil, err
+		}
+		data, err = json.Marshal(ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		file.Encryption = encryptionAES256GCM
+		file.Nonce = nonce
+	}
+
+	sum := sha256.Sum256(data)
+	file.Checksum = hex.EncodeToString(sum[:])
+	file.Data = data
+	return json.Marshal(file)
+}
+
+// decodeDBFile verifies, decrypts and parses the contents of a database file.
+// Files written before checksums were introduced hold the bare structure
+// and are accepted as they are. Unencrypted files are only read without a key.
+func decodeDBFile(path string, content []byte, key []byte) (DBStructure, error) {
+	dbStructure := DBStructure{}
+
+	file := dbFile{}
+	err := json.Unmarshal(content, &file)
+	if err != nil {
+		return dbStructure, &CorruptError{Path: path, Err: err}
+	}
+
+	data := []byte(file.Data)
+	if file.Checksum == "" && file.Data == nil {
+		data = content
+	} else {
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != file.Checksum {
+			return dbStructure, &CorruptError{Path: path, Err: errChecksumMismatch}
+		}
+	}
+
+	if file.Encryption == "" && key != nil {
+		return dbStructure, fmt.Errorf("database file %s: %w", path, ErrNotEncrypted)
+	}
+	if file.Encryption != "" {
+		if file.Encryption != encryptionAES256GCM {
+			return dbStructure, fmt.Errorf("database file %s: unknown encryption %q", path, file.Encryption)
+		}
+		ciphertext := []byte{}
+		err = json.Unmarshal(data, &ciphertext)
+		if err != nil {
+			return dbStructure, &CorruptError{Path: path, Err: err}
+		}
+		data, err = unseal(key, file.Nonce, ciphertext)
+		if err != nil {
+			return dbStructure, fmt.Errorf("database file %s: %w", path, err)
+		}
+	}
+
+	err = json.Unmarshal(data, &dbStructure)
+	if err != nil {
+		return dbStructure, &CorruptError{Path: path, Err: err}
+	}
+	return dbStructure, nil
+}
+
+// readDBFile reads and verifies a database file
+func readDBFile(path string, key []byte) (DBStructure, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return DBStructure{}, err
+	}
+	return decodeDBFile(path, content, key)
+}
+
+// backupPath returns the path of the n-th backup generation of path
+func backupPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// writeFileAtomic replaces the file at path with content so that
+// a crash at any point leaves either the old or the new file behind.
+// The content goes to a temporary file that is synced before it is renamed
+// over the original. With backups > 0 the replaced file is kept
+// as the newest backup generation and older generations are shifted.
+func writeFileAtomic(path string, content []byte, backups int) error {
+	tmpPath := path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if backups > 0 {
+		err = rotateBackups(path, backups)
+		if err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// rotateBackups shifts path.1 .. path.N-1 one generation up
+// and moves the current file to path.1
+func rotateBackups(path string, backups int) error {
+	for n := backups - 1; n >= 1; n-- {
+		err := os.Rename(backupPath(path, n), backupPath(path, n+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	err := os.Rename(path, backupPath(path, 1))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// copyFile copies src to a new file dst, syncing it to disk
+func copyFile(src, dst string) error {
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dst, content, 0)
+}
+
+// syncDir makes renames in dir durable.
+// Not every platform can sync a directory, so errors are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// loadDBFile reads the database file at path, falling back to the newest
+// backup generation that is still intact when the file is corrupt or missing.
+// recovered is the error of the file that was skipped, nil if none was.
+func loadDBFile(path string, backups int, key []byte) (dbStructure DBStructure, recovered error, err error) {
+	dbStructure, err = readDBFile(path, key)
+	if err == nil {
+		return dbStructure, nil, nil
+	}
+
+	var corrupt *CorruptError
+	if !errors.As(err, &corrupt) && !errors.Is(err, os.ErrNotExist) {
+		return dbStructure, nil, err
+	}
+
+	recovered = err
+	for n := 1; n <= backups; n++ {
+		dbStructure, err = readDBFile(backupPath(path, n), key)
+		if err == nil {
+			return dbStructure, recovered, nil
+		}
+	}
+	return DBStructure{}, nil, recovered
+}
+
+// dbFileExists reports whether the file or any of its backups exist
+func dbFileExists(path string, backups int) bool {
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	for n := 1; n <= backups; n++ {
+		if _, err := os.Stat(backupPath(path, n)); !errors.Is(err, os.ErrNotExist) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewDBFallsBackToBackup(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(path string) error
+	}{
+		{
+			name: "truncated",
+			damage: func(path string) error {
+				return os.WriteFile(path, []byte(`{"checksum":"`), 0600)
+			},
+		},
+		{
+			name: "checksum mismatch",
+			damage: func(path string) error {
+				content, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				edited := bytes.Replace(content, []byte("lost"), []byte("LOST"), 1)
+				return os.WriteFile(path, edited, 0600)
+			},
+		},
+		{
+			name:   "missing",
+			damage: os.Remove,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json")
+			db, err := NewDB(path)
+			if err != nil {
+				t.Fatalf("NewDB: %v", err)
+			}
+			user := mustCreateUser(t, db, "a@example.com")
+			// the write of the chirp keeps the file with the user as backup
+			_, err = db.CreateChirp(user.ID, "lost")
+			if err != nil {
+				t.Fatalf("CreateChirp: %v", err)
+			}
+			db.Close()
+
+			err = tt.damage(path)
+			if err != nil {
+				t.Fatalf("damage file: %v", err)
+			}
+
+			db, err = NewDB(path)
+			if err != nil {
+				t.Fatalf("NewDB with a damaged file: %v", err)
+			}
+			defer db.Close()
+
+			if db.Recovered() == nil {
+				t.Error("Recovered() = nil, want why the file was replaced")
+			}
+			if _, err := db.GetUserByEmail("a@example.com"); err != nil {
+				t.Errorf("user of the backup: %v", err)
+			}
+			chirps, err := db.GetChirps()
+			if err != nil {
+				t.Fatalf("GetChirps: %v", err)
+			}
+			if len(chirps) != 0 {
+				t.Errorf("GetChirps() = %v, want the chirps of the backup: none", chirps)
+			}
+
+			// the restored file is intact again
+			_, err = readDBFile(path, nil)
+			if err != nil {
+				t.Errorf("database file after recovery: %v", err)
+			}
+		})
+	}
+}
+
+func TestNewDBKeepsCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	mustCreateUser(t, db, "a@example.com")
+	db.Close()
+
+	garbage := []byte("not json")
+	err = os.WriteFile(path, garbage, 0600)
+	if err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+
+	var corrupt *CorruptError
+	if !errors.As(db.Recovered(), &corrupt) {
+		t.Errorf("Recovered() = %v, want a *CorruptError", db.Recovered())
+	}
+	kept, err := os.ReadFile(path + ".corrupt")
+	if err != nil {
+		t.Fatalf("corrupt file not set aside: %v", err)
+	}
+	if string(kept) != string(garbage) {
+		t.Errorf("set aside file = %q, want %q", kept, garbage)
+	}
+}
+
+func TestNewDBFailsWithoutIntactBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	db.Close()
+
+	err = os.WriteFile(path, []byte("{"), 0600)
+	if err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	_, err = NewDB(path)
+	var corrupt *CorruptError
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("NewDB = %v, want a *CorruptError", err)
+	}
+}
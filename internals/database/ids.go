@@ -0,0 +1,83 @@
+package database
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Collections with an ID sequence
+const (
+	collectionUsers  = "users"
+	collectionChirps = "chirps"
+)
+
+// lastID returns the persisted sequence of a collection.
+// Sequences only ever grow, so an ID is never handed out twice
+// even when the record that had it is deleted.
+func (s *DBStructure) lastID(collection string) *int {
+	switch collection {
+	case collectionUsers:
+		return &s.UserLastID
+	case collectionChirps:
+		return &s.ChirpLastID
+	}
+	panic("no ID sequence for collection " + collection)
+}
+
+// nextID returns the ID the next record of the collection should get.
+// The sequence moves forward once a record with that ID is applied.
+func (s *DBStructure) nextID(collection string) int {
+	return *s.lastID(collection) + 1
+}
+
+// advanceID moves the sequence past id
+func (s *DBStructure) advanceID(collection string, id int) {
+	last := s.lastID(collection)
+	*last = max(*last, id)
+}
+
+// IntegrityError lists the problems found in the data when the DB was opened
+type IntegrityError struct {
+	Problems []string
+}
+
+func (e *IntegrityError) Error() string {
+	return "database integrity check failed: " + strings.Join(e.Problems, "; ")
+}
+
+// checkIntegrity looks for records stored under another ID than their own,
+// IDs ahead of their sequence and users sharing an email
+func (s *DBStructure) checkIntegrity() error {
+	problems := []string{}
+
+	emails := map[string]int{}
+	for key, user := range s.Users {
+		if key != user.ID {
+			problems = append(problems, fmt.Sprintf("user %d is stored as user %d", user.ID, key))
+		}
+		if user.ID > s.UserLastID {
+			problems = append(problems, fmt.Sprintf("user %d is past user_last_id %d", user.ID, s.UserLastID))
+		}
+		email := normalizeEmail(user.Email)
+		if other, exists := emails[email]; exists {
+			problems = append(problems, fmt.Sprintf("users %d and %d share email %q", other, user.ID, email))
+		}
+		emails[email] = user.ID
+	}
+
+	for key, chirp := range s.Chirps {
+		if key != chirp.Id {
+			problems = append(problems, fmt.Sprintf("chirp %d is stored as chirp %d", chirp.Id, key))
+		}
+		if chirp.Id > s.ChirpLastID {
+			problems = append(problems, fmt.Sprintf("chirp %d is past chirp_last_id %d", chirp.Id, s.ChirpLastID))
+		}
+	}
+
+	if len(problems) > 0 {
+		slices.Sort(problems)
+		return &IntegrityError{Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"slices"
+	"strings"
+)
+
+// indexes are lookups derived from the collections of a DBStructure.
+// They are not persisted: buildIndexes creates them after loading
+// and apply keeps them up to date on every change.
+type indexes struct {
+	// lowercased email -> user ID
+	userByEmail map[string]int
+	// author ID -> IDs of their chirps
+	chirpsByAuthor map[int]map[int]struct{}
+	// all chirps in page order, oldest first
+	chirpsByTime []chirpKey
+	// all chirps in ID order
+	chirpsByID []chirpKey
+}
+
+// normalizeEmail is the form emails are compared in, they are case-insensitive
+func normalizeEmail(email string) string {
+	return strings.ToLower(email)
+}
+
+// buildIndexes (re)creates all indexes from the collections
+func (s *DBStructure) buildIndexes() {
+	s.index = &indexes{
+		userByEmail:    make(map[string]int, len(s.Users)),
+		chirpsByAuthor: map[int]map[int]struct{}{},
+	}
+	for _, user := range s.Users {
+		s.index.addUser(user)
+	}
+	s.index.chirpsByTime = make([]chirpKey, 0, len(s.Chirps))
+	for _, chirp := range s.Chirps {
+		s.index.addChirpToAuthor(chirp)
+		s.index.chirpsByTime = append(s.index.chirpsByTime, keyOf(chirp))
+	}
+	s.index.chirpsByID = slices.Clone(s.index.chirpsByTime)
+	slices.SortFunc(s.index.chirpsByTime, OrderByCreatedAt.compare)
+	slices.SortFunc(s.index.chirpsByID, OrderByID.compare)
+}
+
+func (idx *indexes) addUser(user User) {
+	idx.userByEmail[normalizeEmail(user.Email)] = user.ID
+}
+
+func (idx *indexes) removeUser(user User) {
+	email := normalizeEmail(user.Email)
+	if idx.userByEmail[email] == user.ID {
+		delete(idx.userByEmail, email)
+	}
+}
+
+func (idx *indexes) addChirp(chirp Chirp) {
+	idx.addChirpToAuthor(chirp)
+	idx.chirpsByTime = insertKey(idx.chirpsByTime, keyOf(chirp), OrderByCreatedAt)
+	idx.chirpsByID = insertKey(idx.chirpsByID, keyOf(chirp), OrderByID)
+}
+
+func (idx *indexes) addChirpToAuthor(chirp Chirp) {
+	ids, exists := idx.chirpsByAuthor[chirp.AuthorID]
+	if !exists {
+		ids = map[int]struct{}{}
+		idx.chirpsByAuthor[chirp.AuthorID] = ids
+	}
+	ids[chirp.Id] = struct{}{}
+}
+
+func (idx *indexes) removeChirp(chirp Chirp) {
+	ids := idx.chirpsByAuthor[chirp.AuthorID]
+	delete(ids, chirp.Id)
+	if len(ids) == 0 {
+		delete(idx.chirpsByAuthor, chirp.AuthorID)
+	}
+
+	idx.chirpsByTime = removeKey(idx.chirpsByTime, keyOf(chirp), OrderByCreatedAt)
+	idx.chirpsByID = removeKey(idx.chirpsByID, keyOf(chirp), OrderByID)
+}
+
+// insertKey adds a key to keys sorted in the given order
+func insertKey(keys []chirpKey, key chirpKey, order ChirpOrder) []chirpKey {
+	i, _ := slices.BinarySearchFunc(keys, key, order.compare)
+	return slices.Insert(keys, i, key)
+}
+
+// removeKey deletes a key from keys sorted in the given order
+func removeKey(keys []chirpKey, key chirpKey, order ChirpOrder) []chirpKey {
+	i, found := slices.BinarySearchFunc(keys, key, order.compare)
+	if !found {
+		return keys
+	}
+	return slices.Delete(keys, i, i+1)
+}
+
+// userByEmail finds a user by email, ignoring case
+func (s *DBStructure) userByEmail(email string) (User, bool) {
+	id, exists := s.index.userByEmail[normalizeEmail(email)]
+	if !exists {
+		return User{}, false
+	}
+	return s.Users[id], true
+}
+
+// chirpsByAuthor returns all chirps of one author
+func (s *DBStructure) chirpsByAuthor(authorID int) []Chirp {
+	ids := s.index.chirpsByAuthor[authorID]
+	chirps := make([]Chirp, 0, len(ids))
+	for id := range ids {
+		chirps = append(chirps, s.Chirps[id])
+	}
+	return chirps
+}
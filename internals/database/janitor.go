@@ -0,0 +1,70 @@
+package database
+
+import (
+	"time"
+)
+
+// DefaultPruneInterval is how often a janitor prunes if no positive interval is given
+const DefaultPruneInterval = time.Hour
+
+// Janitor removes expired data from a Store in the background
+type Janitor struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// StartJanitor prunes expired revoked and refresh tokens and purges chirps and users
+// deleted longer than retention ago from the store right away
+// and then every interval until Stop is called.
+// onError, if not nil, is called with every failed prune.
+// An interval that is not positive means DefaultPruneInterval.
+func StartJanitor(store Store, interval, retention time.Duration, onError func(error)) *Janitor {
+	if interval <= 0 {
+		interval = DefaultPruneInterval
+	}
+	j := &Janitor{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go j.run(store, interval, retention, onError)
+	return j
+}
+
+func (j *Janitor) run(store Store, interval, retention time.Duration, onError func(error)) {
+	defer close(j.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now().UTC()
+		_, err := store.PruneRevokedTokens(now)
+		if err != nil && onError != nil {
+			onError(err)
+		}
+		_, err = store.PruneRefreshTokens(now)
+		if err != nil && onError != nil {
+			onError(err)
+		}
+		_, err = store.PurgeDeletedChirps(now.Add(-retention))
+		if err != nil && onError != nil {
+			onError(err)
+		}
+		_, err = store.PurgeDeletedUsers(now.Add(-retention))
+		if err != nil && onError != nil {
+			onError(err)
+		}
+
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop ends the janitor, waiting for a prune in progress to finish
+func (j *Janitor) Stop() {
+	close(j.stop)
+	<-j.done
+}
@@ -0,0 +1,62 @@
+package database
+
+import (
+	"errors"
+	"os"
+)
+
+// LockMode decides what a DB does when another process has its files open
+type LockMode int
+
+const (
+	// LockNone does not lock the files, the caller makes sure
+	// only one process uses them at a time
+	LockNone LockMode = iota
+	// LockFail refuses to open the DB while another process holds the lock
+	LockFail
+	// LockWait blocks until the other process releases the lock
+	LockWait
+)
+
+var ErrLocked = errors.New("database is locked by another process")
+
+// fileLock is an advisory lock on path + ".lock" held for as long as the DB is open.
+// The data files themselves are replaced on every write, so they can't carry the lock.
+type fileLock struct {
+	file *os.File
+}
+
+// acquireLock takes the lock for the database at path according to mode
+func acquireLock(path string, mode LockMode) (*fileLock, error) {
+	if mode == LockNone {
+		return nil, nil
+	}
+
+	file, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lockFile(file, mode == LockWait)
+	if err != nil {
+		file.Close()
+		if errors.Is(err, errWouldBlock) {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	return &fileLock{file: file}, nil
+}
+
+// release gives the lock up, it is safe to call on a nil lock
+func (l *fileLock) release() error {
+	if l == nil {
+		return nil
+	}
+
+	err := unlockFile(l.file)
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,250 @@
+package database
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// migration upgrades a DBStructure by one schema version
+type migration struct {
+	description string
+	migrate     func(*DBStructure) error
+}
+
+// migrations[i] upgrades data from schema version i to i+1.
+// Files written before versioning have version 0.
+// Only ever append to this list, released migrations must not change.
+var migrations = []migration{
+	{"create missing collections and fix chirp_last_id", migrateCollections},
+	{"add user_last_id sequence", migrateUserLastID},
+	{"add expires_at to revoked tokens", migrateRevokedTokenExpiry},
+	{"add created_at and updated_at to users and chirps", migrateTimestamps},
+	{"add refresh tokens", migrateRefreshTokens},
+	{"add sessions for refresh token families", migrateSessions},
+	{"rename users whose email only differs in case from an older user's", migrateEmailCase},
+}
+
+// schemaVersion is the version of DBStructure this code reads and writes
+var schemaVersion = len(migrations)
+
+// migrate runs all migrations the structure is missing, in order.
+// It returns the descriptions of the migrations that were run.
+func (s *DBStructure) migrate() ([]string, error) {
+	if s.Version > schemaVersion {
+		return nil, fmt.Errorf("database schema version %d is newer than supported version %d", s.Version, schemaVersion)
+	}
+
+	done := []string{}
+	for s.Version < schemaVersion {
+		m := migrations[s.Version]
+		err := m.migrate(s)
+		if err != nil {
+			return done, fmt.Errorf("migration to version %d (%s): %w", s.Version+1, m.description, err)
+		}
+		s.Version++
+		description := fmt.Sprintf("version %d: %s", s.Version, m.description)
+		if len(s.notes) > 0 {
+			description += " (" + strings.Join(s.notes, "; ") + ")"
+			s.notes = nil
+		}
+		done = append(done, description)
+	}
+	return done, nil
+}
+
+// PlanMigrations reports the migrations NewDB would run on the database file at path.
+// The migrations are tried on a copy in memory, the file is not changed.
+// key is only needed if the file is encrypted.
+func PlanMigrations(path string, key []byte) ([]string, error) {
+	data, err := readDBFile(path, key)
+	if err != nil {
+		return nil, err
+	}
+	return data.migrate()
+}
+
+// migrateDB brings freshly loaded data up to schemaVersion
+// and returns the descriptions of the migrations that were run.
+// The storage is backed up before the migrated data is written back.
+func migrateDB(s storage, data *DBStructure) ([]string, error) {
+	if data.Version == schemaVersion {
+		return nil, nil
+	}
+
+	err := s.backup(fmt.Sprintf(".v%d.bak", data.Version))
+	if err != nil {
+		return nil, err
+	}
+
+	done, err := data.migrate()
+	if err != nil {
+		return nil, err
+	}
+
+	return done, s.rewrite(*data)
+}
+
+// migrateCollections makes sure all collections exist and chirp IDs are never reused
+func migrateCollections(s *DBStructure) error {
+	if s.Chirps == nil {
+		s.Chirps = map[int]Chirp{}
+	}
+	if s.Users == nil {
+		s.Users = map[int]User{}
+	}
+	if s.RevokedTokens == nil {
+		s.RevokedTokens = map[string]RevokedToken{}
+	}
+
+	for id := range s.Chirps {
+		s.ChirpLastID = max(s.ChirpLastID, id)
+	}
+	return nil
+}
+
+// migrateUserLastID starts the user sequence after the highest user ID in use
+func migrateUserLastID(s *DBStructure) error {
+	for id := range s.Users {
+		s.UserLastID = max(s.UserLastID, id)
+	}
+	return nil
+}
+
+// Longest lifetime of a refresh token, revoked tokens from before
+// expires_at was stored can't be valid for longer than this
+const legacyRevokedTokenLifetime = 60 * 24 * time.Hour
+
+// migrateRevokedTokenExpiry gives old revoked tokens the latest expiry they could have
+func migrateRevokedTokenExpiry(s *DBStructure) error {
+	for key, token := range s.RevokedTokens {
+		if token.ExpiresAt.IsZero() {
+			token.ExpiresAt = token.RevokedAt.Add(legacyRevokedTokenLifetime)
+			s.RevokedTokens[key] = token
+		}
+	}
+	return nil
+}
+
+// migrateTimestamps stamps users and chirps from before timestamps were stored
+// with the time of the migration, the real time is not known.
+// IDs keep their relative order when sorting by time.
+func migrateTimestamps(s *DBStructure) error {
+	now := time.Now().UTC()
+	for id, user := range s.Users {
+		if user.CreatedAt.IsZero() {
+			user.CreatedAt = now
+			user.UpdatedAt = now
+			s.Users[id] = user
+		}
+	}
+	for id, chirp := range s.Chirps {
+		if chirp.CreatedAt.IsZero() {
+			chirp.CreatedAt = now
+			chirp.UpdatedAt = now
+			s.Chirps[id] = chirp
+		}
+	}
+	return nil
+}
+
+// migrateRefreshTokens adds the collection of opaque refresh tokens.
+// Refresh tokens issued before are JWTs and are not stored.
+func migrateRefreshTokens(s *DBStructure) error {
+	if s.RefreshTokens == nil {
+		s.RefreshTokens = map[string]RefreshToken{}
+	}
+	return nil
+}
+
+// migrateSessions turns each family of refresh tokens into a session with the
+// family as ID. Who created the session is not known.
+func migrateSessions(s *DBStructure) error {
+	if s.Sessions == nil {
+		s.Sessions = map[string]Session{}
+	}
+
+	for _, token := range s.RefreshTokens {
+		session, exists := s.Sessions[token.Family]
+		if !exists {
+			session = Session{
+				ID:         token.Family,
+				UserID:     token.UserID,
+				CreatedAt:  token.CreatedAt,
+				LastUsedAt: token.CreatedAt,
+				ExpiresAt:  token.ExpiresAt,
+			}
+		}
+		if token.CreatedAt.Before(session.CreatedAt) {
+			session.CreatedAt = token.CreatedAt
+		}
+		if token.CreatedAt.After(session.LastUsedAt) {
+			session.LastUsedAt = token.CreatedAt
+		}
+		if token.ExpiresAt.After(session.ExpiresAt) {
+			session.ExpiresAt = token.ExpiresAt
+		}
+		if token.RevokedAt != nil {
+			session.RevokedAt = token.RevokedAt
+		}
+		s.Sessions[session.ID] = session
+	}
+	return nil
+}
+
+// migrateEmailCase renames users whose email only differs in case from an older
+// user's, as emails are looked up without case. Every rename is noted in the migration description.
+func migrateEmailCase(s *DBStructure) error {
+	ids := make([]int, 0, len(s.Users))
+	emails := make(map[int]string, len(s.Users))
+	for id, user := range s.Users {
+		ids = append(ids, id)
+		emails[id] = user.Email
+	}
+	slices.Sort(ids)
+
+	renames := emailCaseRenames(ids, emails)
+	for _, id := range ids {
+		renamed, ok := renames[id]
+		if !ok {
+			continue
+		}
+		user := s.Users[id]
+		s.notes = append(s.notes, fmt.Sprintf("user %d %s is now %s", id, user.Email, renamed))
+		user.Email = renamed
+		s.Users[id] = user
+	}
+	return nil
+}
+
+// emailCaseRenames picks new emails for the users whose email only differs in case
+// from an older user's. The oldest user keeps the email, the others get dup<ID>.<email>,
+// with more dup. in front until it is not taken. ids must be sorted.
+func emailCaseRenames(ids []int, emails map[int]string) map[int]string {
+	owners := map[string]int{}
+	for _, id := range ids {
+		email := normalizeEmail(emails[id])
+		if _, exists := owners[email]; !exists {
+			owners[email] = id
+		}
+	}
+
+	renames := map[int]string{}
+	for _, id := range ids {
+		if owners[normalizeEmail(emails[id])] == id {
+			continue
+		}
+
+		renamed := fmt.Sprintf("dup%d.%s", id, emails[id])
+		for {
+			if _, exists := owners[normalizeEmail(renamed)]; !exists {
+				break
+			}
+			renamed = "dup." + renamed
+		}
+		owners[normalizeEmail(renamed)] = id
+		renames[id] = renamed
+	}
+	return renames
+}
@@ -0,0 +1,185 @@
+package database
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// unversionedDB is a database file from before schema versions and checksums
+const unversionedDB = `{
+	"chirps": {"3": {"id": 3, "author_id": 1, "body": "old"}},
+	"users": {
+		"1": {"id": 1, "email": "a@example.com", "password": "hash"},
+		"2": {"id": 2, "email": "A@Example.com", "password": "hash"}
+	},
+	"revoked_tokens": {"token": {"token": "token", "revoked_at": "2024-01-01T00:00:00Z"}}
+}`
+
+func TestNewDBMigratesUnversionedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	err := os.WriteFile(path, []byte(unversionedDB), 0600)
+	if err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	defer db.Close()
+
+	if len(db.Migrated()) != schemaVersion {
+		t.Errorf("Migrated() = %q, want all %d migrations", db.Migrated(), schemaVersion)
+	}
+	if _, err := os.Stat(path + ".v0.bak"); err != nil {
+		t.Errorf("no backup of the unmigrated file: %v", err)
+	}
+
+	err = db.View(func(tx *Tx) error {
+		if tx.data.Version != schemaVersion {
+			t.Errorf("version = %d, want %d", tx.data.Version, schemaVersion)
+		}
+		if tx.data.ChirpLastID != 3 || tx.data.UserLastID != 2 {
+			t.Errorf("sequences = chirps %d, users %d, want 3 and 2", tx.data.ChirpLastID, tx.data.UserLastID)
+		}
+		if tx.data.Chirps[3].CreatedAt.IsZero() {
+			t.Error("chirp was not given a creation time")
+		}
+		token := tx.data.RevokedTokens["token"]
+		if want := token.RevokedAt.Add(legacyRevokedTokenLifetime); !token.ExpiresAt.Equal(want) {
+			t.Errorf("revoked token expires at %v, want %v", token.ExpiresAt, want)
+		}
+		if tx.data.RefreshTokens == nil || tx.data.Sessions == nil {
+			t.Error("refresh token and session collections were not created")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the older user keeps the email, the newer one is renamed
+	user, err := db.GetUserByEmail("a@example.com")
+	if err != nil || user.ID != 1 {
+		t.Errorf("GetUserByEmail(a@example.com) = %+v, %v, want user 1", user, err)
+	}
+	user, err = db.GetUser(2)
+	if err != nil || user.Email != "dup2.A@Example.com" {
+		t.Errorf("GetUser(2) = %+v, %v, want it renamed to dup2.A@Example.com", user, err)
+	}
+}
+
+func TestPlanMigrationsLeavesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	err := os.WriteFile(path, []byte(unversionedDB), 0600)
+	if err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	planned, err := PlanMigrations(path, nil)
+	if err != nil {
+		t.Fatalf("PlanMigrations: %v", err)
+	}
+	if len(planned) != schemaVersion {
+		t.Errorf("PlanMigrations() = %q, want all %d migrations", planned, schemaVersion)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read file: %v", err)
+	}
+	if string(content) != unversionedDB {
+		t.Error("PlanMigrations changed the file")
+	}
+}
+
+func TestNewDBRejectsNewerVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	err := os.WriteFile(path, []byte(`{"version": 1000}`), 0600)
+	if err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	_, err = NewDB(path)
+	if err == nil {
+		t.Fatal("NewDB opened a file of a newer schema version")
+	}
+}
+
+func TestNewSQLDBMigratesFromFirstVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.sqlite")
+
+	// a database that only ever ran the first migration
+	old, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	script, err := sqlMigrations.ReadFile("migrations/0001_create_tables.sql")
+	if err != nil {
+		t.Fatalf("read migration: %v", err)
+	}
+	for _, query := range []string{
+		`CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY, name TEXT NOT NULL, applied_at DATETIME NOT NULL)`,
+		string(script),
+		`INSERT INTO schema_migrations (version, name, applied_at) VALUES (1, '0001_create_tables.sql', '2024-01-01')`,
+		`INSERT INTO users (id, email, hashed_password) VALUES (1, 'a@example.com', 'hash'), (2, 'A@Example.com', 'hash'), (3, 'dup2.a@example.com', 'hash')`,
+		`INSERT INTO chirps (id, author_id, body) VALUES (1, 2, 'old')`,
+	} {
+		_, err = old.Exec(query)
+		if err != nil {
+			t.Fatalf("prepare old database: %v", err)
+		}
+	}
+	old.Close()
+
+	db, err := NewSQLDB(path)
+	if err != nil {
+		t.Fatalf("NewSQLDB: %v", err)
+	}
+	defer db.Close()
+
+	names, err := sqlMigrations.ReadDir("migrations")
+	if err != nil {
+		t.Fatalf("list migrations: %v", err)
+	}
+	version := 0
+	err = db.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		t.Fatalf("read version: %v", err)
+	}
+	if version != len(names) {
+		t.Errorf("schema version = %d, want %d", version, len(names))
+	}
+
+	// the first choice of a new email is taken by user 3
+	user, err := db.GetUser(2)
+	if err != nil || user.Email != "dup.dup2.A@Example.com" {
+		t.Errorf("GetUser(2) = %+v, %v, want it renamed to dup.dup2.A@Example.com", user, err)
+	}
+	migrated := db.Migrated()
+	if len(migrated) != len(names)-1 {
+		t.Fatalf("Migrated() = %q, want the %d migrations after the first", migrated, len(names)-1)
+	}
+	if want := "0002_users_email_nocase.sql (user 2 A@Example.com is now dup.dup2.A@Example.com)"; migrated[0] != want {
+		t.Errorf("Migrated()[0] = %q, want %q", migrated[0], want)
+	}
+
+	// the old rows work with everything added since
+	chirp, err := db.GetChirp(1)
+	if err != nil {
+		t.Fatalf("GetChirp: %v", err)
+	}
+	if chirp.Deleted() {
+		t.Error("old chirp reads as deleted")
+	}
+	_, err = db.CreateSession(1, Client{}, SessionTokens{
+		RefreshTokenHash: "hash",
+		RefreshExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Errorf("CreateSession for an old user: %v", err)
+	}
+}
@@ -0,0 +1,21 @@
+CREATE TABLE users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email TEXT NOT NULL,
+	hashed_password TEXT NOT NULL,
+	is_chirpy_red INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE UNIQUE INDEX users_email ON users (email);
+
+CREATE TABLE chirps (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	author_id INTEGER NOT NULL REFERENCES users (id),
+	body TEXT NOT NULL
+);
+
+CREATE INDEX chirps_author_id ON chirps (author_id);
+
+CREATE TABLE revoked_tokens (
+	token TEXT PRIMARY KEY,
+	revoked_at DATETIME NOT NULL
+);
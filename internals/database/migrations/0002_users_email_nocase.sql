@@ -0,0 +1,3 @@
+DROP INDEX users_email;
+
+CREATE UNIQUE INDEX users_email ON users (email COLLATE NOCASE);
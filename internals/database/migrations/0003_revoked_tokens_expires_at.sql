@@ -0,0 +1,7 @@
+-- Unix seconds, so expiry can be compared in SQL.
+-- Tokens revoked before this column existed get the longest refresh token lifetime of 60 days.
+ALTER TABLE revoked_tokens ADD COLUMN expires_at INTEGER NOT NULL DEFAULT 0;
+
+UPDATE revoked_tokens SET expires_at = unixepoch(substr(revoked_at, 1, 19)) + 60 * 24 * 60 * 60;
+
+CREATE INDEX revoked_tokens_expires_at ON revoked_tokens (expires_at);
@@ -0,0 +1,11 @@
+-- Unix nanoseconds, so records can be ordered by time in SQL.
+-- Rows from before this migration get the time it ran, the real time is not known.
+ALTER TABLE users ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE chirps ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE chirps ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+
+UPDATE users SET created_at = unixepoch() * 1000000000, updated_at = unixepoch() * 1000000000;
+UPDATE chirps SET created_at = unixepoch() * 1000000000, updated_at = unixepoch() * 1000000000;
+
+CREATE INDEX chirps_created_at ON chirps (created_at);
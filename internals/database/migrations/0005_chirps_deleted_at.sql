@@ -0,0 +1,5 @@
+-- Unix nanoseconds the chirp was deleted at, NULL while it is not deleted.
+-- Deleted chirps stay as tombstones until they are purged.
+ALTER TABLE chirps ADD COLUMN deleted_at INTEGER;
+
+CREATE INDEX chirps_deleted_at ON chirps (deleted_at) WHERE deleted_at IS NOT NULL;
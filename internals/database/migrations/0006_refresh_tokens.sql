@@ -0,0 +1,15 @@
+-- Opaque refresh tokens, stored by the SHA-256 of the token.
+-- family is the hash of the token the login issued, shared by all tokens it was rotated into.
+-- Times are Unix nanoseconds, used_at and revoked_at are NULL until the token is used or revoked.
+CREATE TABLE refresh_tokens (
+	hash TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users (id),
+	family TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL,
+	used_at INTEGER,
+	revoked_at INTEGER
+);
+
+CREATE INDEX refresh_tokens_family ON refresh_tokens (family);
+CREATE INDEX refresh_tokens_expires_at ON refresh_tokens (expires_at);
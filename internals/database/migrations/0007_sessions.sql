@@ -0,0 +1,21 @@
+-- A session is a login, its refresh tokens have the session ID as family.
+-- Each family of refresh tokens from before sessions becomes a session with the family as ID,
+-- who created it is not known. Times are Unix nanoseconds.
+CREATE TABLE sessions (
+	id TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users (id),
+	created_at INTEGER NOT NULL,
+	last_used_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL,
+	user_agent TEXT NOT NULL DEFAULT '',
+	ip TEXT NOT NULL DEFAULT '',
+	revoked_at INTEGER
+);
+
+INSERT INTO sessions (id, user_id, created_at, last_used_at, expires_at, revoked_at)
+SELECT family, user_id, MIN(created_at), MAX(created_at), MAX(expires_at), MAX(revoked_at)
+FROM refresh_tokens
+GROUP BY family;
+
+CREATE INDEX sessions_user_id ON sessions (user_id);
+CREATE INDEX sessions_expires_at ON sessions (expires_at);
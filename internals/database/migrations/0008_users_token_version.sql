@@ -0,0 +1,2 @@
+-- Bumped to reject all access tokens of the user issued before
+ALTER TABLE users ADD COLUMN token_version INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+-- The jti of the newest access token of a session, denied when the session is revoked.
+-- access_expires_at is Unix nanoseconds.
+ALTER TABLE sessions ADD COLUMN access_token_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN access_expires_at INTEGER NOT NULL DEFAULT 0;
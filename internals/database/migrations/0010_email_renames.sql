@@ -0,0 +1,6 @@
+-- Databases that ran 0002 before it resolved emails differing in case have no email_renames yet
+CREATE TABLE IF NOT EXISTS email_renames (
+	user_id INTEGER NOT NULL REFERENCES users (id),
+	old_email TEXT NOT NULL,
+	new_email TEXT NOT NULL
+);
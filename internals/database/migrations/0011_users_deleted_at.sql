@@ -0,0 +1,5 @@
+-- Unix nanoseconds the user was deleted at, NULL while it is not deleted.
+-- Deleted users stay as tombstones, keeping their email, until they are purged.
+ALTER TABLE users ADD COLUMN deleted_at INTEGER;
+
+CREATE INDEX users_deleted_at ON users (deleted_at) WHERE deleted_at IS NOT NULL;
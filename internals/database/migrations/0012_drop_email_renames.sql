@@ -0,0 +1,3 @@
+-- Renames of emails that only differ in case are reported when the migrations run.
+-- email_renames was never read, the renames it recorded are reported once more before it goes.
+DROP TABLE email_renames;
@@ -0,0 +1,282 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 200
+)
+
+// ChirpOrder is what a page of chirps is sorted by
+type ChirpOrder int
+
+const (
+	// OrderByCreatedAt sorts by creation time and by ID for chirps created at the same time
+	OrderByCreatedAt ChirpOrder = iota
+	OrderByID
+)
+
+func (o ChirpOrder) compare(a, b chirpKey) int {
+	if o == OrderByCreatedAt {
+		return compareChirpKeys(a, b)
+	}
+	return a.ID - b.ID
+}
+
+// ChirpQuery selects one page of chirps. All filters that are set must match.
+type ChirpQuery struct {
+	// AuthorIDs limits the chirps to these authors, all authors if empty
+	AuthorIDs []int
+	// ExcludeAuthorIDs leaves out chirps of these authors
+	ExcludeAuthorIDs []int
+	// CreatedAfter and CreatedBefore limit the creation time, exclusive, unbounded if zero
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// BodyContains is searched for in the body ignoring case
+	BodyContains string
+
+	OrderBy    ChirpOrder
+	Descending bool
+	// Limit is the page size, DefaultPageLimit if 0
+	Limit int
+	// Cursor is NextCursor or PrevCursor of another page of the same query,
+	// empty for the first page
+	Cursor string
+}
+
+// matches reports whether a chirp passes the filters of the query
+func (q ChirpQuery) matches(chirp Chirp) bool {
+	switch {
+	case chirp.Deleted():
+		return false
+	case len(q.AuthorIDs) > 0 && !slices.Contains(q.AuthorIDs, chirp.AuthorID):
+		return false
+	case slices.Contains(q.ExcludeAuthorIDs, chirp.AuthorID):
+		return false
+	case !q.CreatedAfter.IsZero() && !chirp.CreatedAt.After(q.CreatedAfter):
+		return false
+	case !q.CreatedBefore.IsZero() && !chirp.CreatedAt.Before(q.CreatedBefore):
+		return false
+	case q.BodyContains != "" && !strings.Contains(strings.ToLower(chirp.Body), strings.ToLower(q.BodyContains)):
+		return false
+	}
+	return true
+}
+
+// ChirpPage is one page of chirps.
+// The cursors are empty when there is nothing more in their direction.
+type ChirpPage struct {
+	Chirps     []Chirp
+	NextCursor string
+	PrevCursor string
+}
+
+// chirpKey is the position of a chirp in page order.
+// Pages start after a key rather than at an offset,
+// so chirps added or deleted elsewhere don't shift them.
+type chirpKey struct {
+	CreatedAt time.Time
+	ID        int
+}
+
+func keyOf(chirp Chirp) chirpKey {
+	return chirpKey{CreatedAt: chirp.CreatedAt, ID: chirp.Id}
+}
+
+func compareChirpKeys(a, b chirpKey) int {
+	if order := a.CreatedAt.Compare(b.CreatedAt); order != 0 {
+		return order
+	}
+	return a.ID - b.ID
+}
+
+// cursor is what an opaque cursor string holds
+type cursor struct {
+	CreatedAt  int64      `json:"t"`
+	ID         int        `json:"i"`
+	Backward   bool       `json:"b,omitempty"`
+	Descending bool       `json:"d,omitempty"`
+	OrderBy    ChirpOrder `json:"o,omitempty"`
+}
+
+func encodeCursor(key chirpKey, backward bool, q ChirpQuery) string {
+	data, _ := json.Marshal(cursor{
+		CreatedAt:  key.CreatedAt.UnixNano(),
+		ID:         key.ID,
+		Backward:   backward,
+		Descending: q.Descending,
+		OrderBy:    q.OrderBy,
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+	c := cursor{}
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// chirpScan returns up to limit chirps matching the query in ascending or descending
+// page order, starting right after the key, or at the start if after is nil
+type chirpScan func(descending bool, after *chirpKey, limit int) ([]Chirp, error)
+
+// paginate finds the page of the query with scan and the cursors around it
+func paginate(q ChirpQuery, scan chirpScan) (ChirpPage, error) {
+	limit := q.Limit
+	if limit == 0 {
+		limit = DefaultPageLimit
+	}
+	if limit < 0 || limit > MaxPageLimit {
+		return ChirpPage{}, errors.New("limit out of range")
+	}
+
+	var after *chirpKey
+	backward := false
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return ChirpPage{}, err
+		}
+		// a cursor of one sort order means nothing in the other
+		if c.Descending != q.Descending || c.OrderBy != q.OrderBy {
+			return ChirpPage{}, ErrInvalidCursor
+		}
+		after = &chirpKey{CreatedAt: time.Unix(0, c.CreatedAt).UTC(), ID: c.ID}
+		backward = c.Backward
+	}
+
+	// going back to the previous page scans in the opposite order
+	scanDescending := q.Descending != backward
+	chirps, err := scan(scanDescending, after, limit+1)
+	if err != nil {
+		return ChirpPage{}, err
+	}
+	more := len(chirps) > limit
+	chirps = chirps[:min(len(chirps), limit)]
+	if backward {
+		slices.Reverse(chirps)
+	}
+
+	page := ChirpPage{Chirps: chirps}
+	if len(chirps) == 0 {
+		// nothing past the cursor, but there may be something before it
+		if after != nil {
+			if backward {
+				page.NextCursor = encodeCursor(*after, false, q)
+			} else {
+				page.PrevCursor = encodeCursor(*after, true, q)
+			}
+		}
+		return page, nil
+	}
+
+	first, last := keyOf(chirps[0]), keyOf(chirps[len(chirps)-1])
+	hasNext, hasPrev := more, more
+	if backward {
+		hasNext, err = scanAny(scan, q.Descending, last)
+	} else {
+		hasPrev = false
+		if after != nil {
+			hasPrev, err = scanAny(scan, !q.Descending, first)
+		}
+	}
+	if err != nil {
+		return ChirpPage{}, err
+	}
+
+	if hasNext {
+		page.NextCursor = encodeCursor(last, false, q)
+	}
+	if hasPrev {
+		page.PrevCursor = encodeCursor(first, true, q)
+	}
+	return page, nil
+}
+
+// scanAny reports whether there are chirps after the key in the given order
+func scanAny(scan chirpScan, descending bool, after chirpKey) (bool, error) {
+	chirps, err := scan(descending, &after, 1)
+	return len(chirps) > 0, err
+}
+
+// GetChirpsPage returns one page of chirps that are not deleted
+func (db *DB) GetChirpsPage(q ChirpQuery) (page ChirpPage, err error) {
+	err = db.View(func(tx *Tx) error {
+		page, err = tx.GetChirpsPage(q)
+		return err
+	})
+	return page, err
+}
+
+func (tx *Tx) GetChirpsPage(q ChirpQuery) (ChirpPage, error) {
+	return paginate(q, func(descending bool, after *chirpKey, limit int) ([]Chirp, error) {
+		return tx.data.scanChirps(q, descending, after, limit), nil
+	})
+}
+
+// scanChirps walks the chirps in page order from after, collecting those the query matches
+func (s *DBStructure) scanChirps(q ChirpQuery, descending bool, after *chirpKey, limit int) []Chirp {
+	keys := s.chirpKeys(q)
+
+	i, step := 0, 1
+	if descending {
+		i, step = len(keys)-1, -1
+	}
+	if after != nil {
+		pos, found := slices.BinarySearchFunc(keys, *after, q.OrderBy.compare)
+		switch {
+		case !descending && found:
+			i = pos + 1
+		case !descending:
+			i = pos
+		default:
+			i = pos - 1
+		}
+	}
+
+	chirps := []Chirp{}
+	for ; i >= 0 && i < len(keys) && len(chirps) < limit; i += step {
+		chirp := s.Chirps[keys[i].ID]
+		if !q.matches(chirp) {
+			continue
+		}
+		chirps = append(chirps, chirp)
+	}
+	return chirps
+}
+
+// chirpKeys returns the keys of the chirps the query can match in page order.
+// With authors given only their chirps are looked at.
+func (s *DBStructure) chirpKeys(q ChirpQuery) []chirpKey {
+	if len(q.AuthorIDs) == 0 {
+		if q.OrderBy == OrderByID {
+			return s.index.chirpsByID
+		}
+		return s.index.chirpsByTime
+	}
+
+	keys := []chirpKey{}
+	for _, authorID := range q.AuthorIDs {
+		for id := range s.index.chirpsByAuthor[authorID] {
+			keys = append(keys, keyOf(s.Chirps[id]))
+		}
+	}
+	slices.SortFunc(keys, q.OrderBy.compare)
+	return slices.CompactFunc(keys, func(a, b chirpKey) bool { return a.ID == b.ID })
+}
@@ -0,0 +1,157 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+// chirpIDs returns the IDs of the chirps in order
+func chirpIDs(chirps []Chirp) []int {
+	ids := make([]int, 0, len(chirps))
+	for _, chirp := range chirps {
+		ids = append(ids, chirp.Id)
+	}
+	return ids
+}
+
+func TestGetChirpsPageWalksAllPages(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user := mustCreateUser(t, store, "a@example.com")
+			want := []int{}
+			for i := 0; i < 25; i++ {
+				chirp, err := store.CreateChirp(user.ID, "chirp")
+				if err != nil {
+					t.Fatalf("CreateChirp: %v", err)
+				}
+				want = append(want, chirp.Id)
+			}
+
+			for _, descending := range []bool{false, true} {
+				q := ChirpQuery{Limit: 10, Descending: descending}
+				pages := [][]int{}
+				for {
+					page, err := store.GetChirpsPage(q)
+					if err != nil {
+						t.Fatalf("GetChirpsPage: %v", err)
+					}
+					pages = append(pages, chirpIDs(page.Chirps))
+					if page.NextCursor == "" {
+						break
+					}
+					q.Cursor = page.NextCursor
+				}
+
+				expected := slices.Clone(want)
+				if descending {
+					slices.Reverse(expected)
+				}
+				if got := slices.Concat(pages...); !slices.Equal(got, expected) {
+					t.Errorf("descending %v: pages %v, want %v", descending, pages, expected)
+				}
+				if len(pages) != 3 {
+					t.Errorf("descending %v: %d pages, want 3", descending, len(pages))
+				}
+			}
+		})
+	}
+}
+
+func TestGetChirpsPageGoesBack(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user := mustCreateUser(t, store, "a@example.com")
+			for i := 0; i < 7; i++ {
+				_, err := store.CreateChirp(user.ID, "chirp")
+				if err != nil {
+					t.Fatalf("CreateChirp: %v", err)
+				}
+			}
+
+			first, err := store.GetChirpsPage(ChirpQuery{Limit: 3})
+			if err != nil {
+				t.Fatalf("first page: %v", err)
+			}
+			if first.PrevCursor != "" {
+				t.Error("first page has a previous page")
+			}
+			second, err := store.GetChirpsPage(ChirpQuery{Limit: 3, Cursor: first.NextCursor})
+			if err != nil {
+				t.Fatalf("second page: %v", err)
+			}
+			back, err := store.GetChirpsPage(ChirpQuery{Limit: 3, Cursor: second.PrevCursor})
+			if err != nil {
+				t.Fatalf("back to the first page: %v", err)
+			}
+			if !slices.Equal(chirpIDs(back.Chirps), chirpIDs(first.Chirps)) {
+				t.Errorf("going back gave %v, want the first page %v", chirpIDs(back.Chirps), chirpIDs(first.Chirps))
+			}
+			if back.PrevCursor != "" {
+				t.Error("going back to the first page left a previous page")
+			}
+		})
+	}
+}
+
+func TestGetChirpsPageIsStableUnderDeletes(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user := mustCreateUser(t, store, "a@example.com")
+			ids := []int{}
+			for i := 0; i < 6; i++ {
+				chirp, err := store.CreateChirp(user.ID, "chirp")
+				if err != nil {
+					t.Fatalf("CreateChirp: %v", err)
+				}
+				ids = append(ids, chirp.Id)
+			}
+
+			first, err := store.GetChirpsPage(ChirpQuery{Limit: 2})
+			if err != nil {
+				t.Fatalf("first page: %v", err)
+			}
+			// deleting a chirp of the first page must not shift the next one
+			err = store.DeleteChirp(ids[0])
+			if err != nil {
+				t.Fatalf("DeleteChirp: %v", err)
+			}
+			second, err := store.GetChirpsPage(ChirpQuery{Limit: 2, Cursor: first.NextCursor})
+			if err != nil {
+				t.Fatalf("second page: %v", err)
+			}
+			if got := chirpIDs(second.Chirps); !slices.Equal(got, ids[2:4]) {
+				t.Errorf("second page = %v, want %v", got, ids[2:4])
+			}
+		})
+	}
+}
+
+func TestGetChirpsPageRejectsBadCursors(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user := mustCreateUser(t, store, "a@example.com")
+			for i := 0; i < 3; i++ {
+				_, err := store.CreateChirp(user.ID, "chirp")
+				if err != nil {
+					t.Fatalf("CreateChirp: %v", err)
+				}
+			}
+			page, err := store.GetChirpsPage(ChirpQuery{Limit: 1})
+			if err != nil {
+				t.Fatalf("GetChirpsPage: %v", err)
+			}
+
+			for _, q := range []ChirpQuery{
+				{Limit: 1, Cursor: "not a cursor"},
+				{Limit: 1, Cursor: page.NextCursor, Descending: true},
+				{Limit: 1, Cursor: page.NextCursor, OrderBy: OrderByID},
+			} {
+				_, err = store.GetChirpsPage(q)
+				if !errors.Is(err, ErrInvalidCursor) {
+					t.Errorf("GetChirpsPage(%+v) = %v, want ErrInvalidCursor", q, err)
+				}
+			}
+		})
+	}
+}
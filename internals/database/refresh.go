@@ -0,0 +1,170 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrTokenExpired = errors.New("token expired")
+	ErrTokenRevoked = errors.New("token revoked")
+	ErrTokenReused  = errors.New("token already used, all tokens of its login were revoked")
+)
+
+// RefreshToken is an opaque refresh token, stored by the hash of the token
+// so the data doesn't hold tokens that can be used.
+// Each refresh replaces the token with a new one of the same family.
+type RefreshToken struct {
+	Hash   string `json:"hash"`
+	UserID int    `json:"user_id"`
+	// Family is the ID of the Session the token belongs to,
+	// shared by all tokens it was rotated into
+	Family    string    `json:"family"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// UsedAt is when the token was rotated, using it again is a replay
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// RotateRefreshToken replaces the token with hash by the new tokens of its session.
+// Replaying a used token revokes its whole session and returns ErrTokenReused.
+func (db *DB) RotateRefreshToken(hash string, tokens SessionTokens) (token RefreshToken, err error) {
+	var rotateErr error
+	err = db.Update(func(tx *Tx) error {
+		token, rotateErr = tx.RotateRefreshToken(hash, tokens)
+		// the revoked session has to be saved
+		if errors.Is(rotateErr, ErrTokenReused) {
+			return nil
+		}
+		return rotateErr
+	})
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	return token, rotateErr
+}
+
+// RevokeRefreshToken revokes the token with hash and the rest of its session
+func (db *DB) RevokeRefreshToken(hash string) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.RevokeRefreshToken(hash)
+	})
+}
+
+// ExchangeLegacyRefreshToken revokes a refresh token from before they were opaque
+// and starts a session of its user in its place, in one transaction.
+// Returns ErrTokenRevoked if the token was revoked or exchanged before.
+func (db *DB) ExchangeLegacyRefreshToken(tokenString string, expiresAt time.Time, userID int, client Client, tokens SessionTokens) (session Session, err error) {
+	err = db.Update(func(tx *Tx) error {
+		session, err = tx.ExchangeLegacyRefreshToken(tokenString, expiresAt, userID, client, tokens)
+		return err
+	})
+	return session, err
+}
+
+// PruneRefreshTokens deletes refresh tokens and sessions that expired before the given time.
+// Returns how many refresh tokens were deleted.
+func (db *DB) PruneRefreshTokens(before time.Time) (pruned int, err error) {
+	err = db.Update(func(tx *Tx) error {
+		pruned, err = tx.PruneRefreshTokens(before)
+		return err
+	})
+	return pruned, err
+}
+
+// RotateRefreshToken marks the token with hash as used and stores its replacement.
+// Returns ErrNotExists, ErrTokenRevoked or ErrTokenExpired if the token can't be used.
+// Replaying a used token revokes its session and returns ErrTokenReused,
+// the revocation has to be committed.
+func (tx *Tx) RotateRefreshToken(hash string, tokens SessionTokens) (RefreshToken, error) {
+	old, exists := tx.data.RefreshTokens[hash]
+	if !exists {
+		return RefreshToken{}, ErrNotExists
+	}
+	if old.RevokedAt != nil {
+		return RefreshToken{}, ErrTokenRevoked
+	}
+	if old.UsedAt != nil {
+		err := tx.revokeSession(old.Family)
+		if err != nil {
+			return RefreshToken{}, err
+		}
+		return RefreshToken{}, ErrTokenReused
+	}
+	now := time.Now().UTC()
+	if !old.ExpiresAt.After(now) {
+		return RefreshToken{}, ErrTokenExpired
+	}
+	if _, exists := tx.data.RefreshTokens[tokens.RefreshTokenHash]; exists {
+		return RefreshToken{}, ErrAlreadyExists
+	}
+
+	old.UsedAt = &now
+	token := RefreshToken{
+		Hash:      tokens.RefreshTokenHash,
+		UserID:    old.UserID,
+		Family:    old.Family,
+		CreatedAt: now,
+		ExpiresAt: tokens.RefreshExpiresAt.UTC(),
+	}
+	changes := []change{putRefreshToken(old), putRefreshToken(token)}
+	if session, exists := tx.data.Sessions[old.Family]; exists {
+		session.LastUsedAt = now
+		session.ExpiresAt = token.ExpiresAt
+		session.AccessTokenID = tokens.AccessTokenID
+		session.AccessExpiresAt = tokens.AccessExpiresAt.UTC()
+		changes = append(changes, putSession(session))
+	}
+	err := tx.apply(changes...)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	return token, nil
+}
+
+// RevokeRefreshToken revokes the token with hash and the rest of its session
+func (tx *Tx) RevokeRefreshToken(hash string) error {
+	token, exists := tx.data.RefreshTokens[hash]
+	if !exists {
+		return ErrNotExists
+	}
+	return tx.revokeSession(token.Family)
+}
+
+func (tx *Tx) ExchangeLegacyRefreshToken(tokenString string, expiresAt time.Time, userID int, client Client, tokens SessionTokens) (Session, error) {
+	if _, revoked := tx.data.RevokedTokens[tokenString]; revoked {
+		return Session{}, ErrTokenRevoked
+	}
+
+	err := tx.AddRevokedToken(tokenString, expiresAt)
+	if err != nil {
+		return Session{}, err
+	}
+	return tx.CreateSession(userID, client, tokens)
+}
+
+func (tx *Tx) PruneRefreshTokens(before time.Time) (int, error) {
+	pruned := 0
+	for _, token := range tx.data.RefreshTokens {
+		if !token.ExpiresAt.Before(before) {
+			continue
+		}
+		err := tx.apply(deleteRefreshToken(token.Hash))
+		if err != nil {
+			return 0, err
+		}
+		pruned++
+	}
+
+	for _, session := range tx.data.Sessions {
+		if !session.ExpiresAt.Before(before) {
+			continue
+		}
+		err := tx.apply(deleteSession(session.ID))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return pruned, nil
+}
@@ -0,0 +1,125 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// testTokens are the tokens of a login or refresh with the given refresh token hash
+func testTokens(hash string) SessionTokens {
+	return SessionTokens{
+		RefreshTokenHash: hash,
+		RefreshExpiresAt: time.Now().Add(time.Hour),
+		AccessTokenID:    "jti-" + hash,
+		AccessExpiresAt:  time.Now().Add(time.Hour),
+	}
+}
+
+func TestRotateRefreshTokenDetectsReuse(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user := mustCreateUser(t, store, "a@example.com")
+			session, err := store.CreateSession(user.ID, Client{}, testTokens("first"))
+			if err != nil {
+				t.Fatalf("CreateSession: %v", err)
+			}
+
+			token, err := store.RotateRefreshToken("first", testTokens("second"))
+			if err != nil {
+				t.Fatalf("RotateRefreshToken: %v", err)
+			}
+			if token.Family != session.ID || token.UserID != user.ID {
+				t.Errorf("rotated token = %+v, want it in session %s of user %d", token, session.ID, user.ID)
+			}
+
+			// a replay of the used token ends the whole session
+			_, err = store.RotateRefreshToken("first", testTokens("stolen"))
+			if !errors.Is(err, ErrTokenReused) {
+				t.Fatalf("replaying a used token = %v, want ErrTokenReused", err)
+			}
+			_, err = store.RotateRefreshToken("second", testTokens("third"))
+			if !errors.Is(err, ErrTokenRevoked) {
+				t.Errorf("rotating the newest token after a replay = %v, want ErrTokenRevoked", err)
+			}
+
+			sessions, err := store.GetSessions(user.ID)
+			if err != nil {
+				t.Fatalf("GetSessions: %v", err)
+			}
+			if len(sessions) != 0 {
+				t.Errorf("GetSessions() = %+v, want the session revoked", sessions)
+			}
+			denied, err := store.IsTokenRevoked("jti-second")
+			if err != nil {
+				t.Fatalf("IsTokenRevoked: %v", err)
+			}
+			if !denied {
+				t.Error("the newest access token of the revoked session is still accepted")
+			}
+		})
+	}
+}
+
+func TestRotateRefreshTokenRejects(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user := mustCreateUser(t, store, "a@example.com")
+			expired := testTokens("expired")
+			expired.RefreshExpiresAt = time.Now().Add(-time.Minute)
+			_, err := store.CreateSession(user.ID, Client{}, expired)
+			if err != nil {
+				t.Fatalf("CreateSession: %v", err)
+			}
+			_, err = store.CreateSession(user.ID, Client{}, testTokens("revoked"))
+			if err != nil {
+				t.Fatalf("CreateSession: %v", err)
+			}
+			err = store.RevokeRefreshToken("revoked")
+			if err != nil {
+				t.Fatalf("RevokeRefreshToken: %v", err)
+			}
+
+			tests := []struct {
+				hash string
+				want error
+			}{
+				{"unknown", ErrNotExists},
+				{"expired", ErrTokenExpired},
+				{"revoked", ErrTokenRevoked},
+			}
+			for _, tt := range tests {
+				_, err = store.RotateRefreshToken(tt.hash, testTokens("new-"+tt.hash))
+				if !errors.Is(err, tt.want) {
+					t.Errorf("RotateRefreshToken(%q) = %v, want %v", tt.hash, err, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestExchangeLegacyRefreshTokenOnce(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user := mustCreateUser(t, store, "a@example.com")
+			expiresAt := time.Now().Add(time.Hour)
+
+			_, err := store.ExchangeLegacyRefreshToken("a.b.c", expiresAt, user.ID, Client{}, testTokens("first"))
+			if err != nil {
+				t.Fatalf("ExchangeLegacyRefreshToken: %v", err)
+			}
+			_, err = store.ExchangeLegacyRefreshToken("a.b.c", expiresAt, user.ID, Client{}, testTokens("second"))
+			if !errors.Is(err, ErrTokenRevoked) {
+				t.Errorf("exchanging the token again = %v, want ErrTokenRevoked", err)
+			}
+
+			sessions, err := store.GetSessions(user.ID)
+			if err != nil {
+				t.Fatalf("GetSessions: %v", err)
+			}
+			if len(sessions) != 1 {
+				t.Errorf("GetSessions() = %+v, want the one session of the exchange", sessions)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package database
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"slices"
+	"time"
+)
+
+// Session is a login, from POST /api/login until it is revoked or its
+// refresh token expires. Its refresh tokens have the session ID as Family.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     int       `json:"user_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	// ExpiresAt is when the newest refresh token of the session expires
+	ExpiresAt time.Time  `json:"expires_at"`
+	UserAgent string     `json:"user_agent"`
+	IP        string     `json:"ip"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	// AccessTokenID is the jti of the newest access token of the session,
+	// denied when the session is revoked
+	AccessTokenID   string    `json:"access_token_id,omitempty"`
+	AccessExpiresAt time.Time `json:"access_expires_at"`
+}
+
+// Active reports whether the session can still be refreshed at now
+func (s Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && s.ExpiresAt.After(now)
+}
+
+// SessionTokens are the tokens a session is handed at login or refresh
+type SessionTokens struct {
+	RefreshTokenHash string
+	RefreshExpiresAt time.Time
+	// AccessTokenID is the jti of the access token
+	AccessTokenID   string
+	AccessExpiresAt time.Time
+}
+
+// Client is who a session was created by
+type Client struct {
+	UserAgent string
+	IP        string
+}
+
+func newSessionID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// sortSessions puts the most recently used sessions first
+func sortSessions(sessions []Session) {
+	slices.SortFunc(sessions, func(a, b Session) int {
+		return cmp.Or(b.LastUsedAt.Compare(a.LastUsedAt), cmp.Compare(a.ID, b.ID))
+	})
+}
+
+// CreateSession starts a session of the user with its first refresh token
+func (db *DB) CreateSession(userID int, client Client, tokens SessionTokens) (session Session, err error) {
+	err = db.Update(func(tx *Tx) error {
+		session, err = tx.CreateSession(userID, client, tokens)
+		return err
+	})
+	return session, err
+}
+
+// GetSessions returns the active sessions of the user, most recently used first
+func (db *DB) GetSessions(userID int) (sessions []Session, err error) {
+	err = db.View(func(tx *Tx) error {
+		sessions, err = tx.GetSessions(userID)
+		return err
+	})
+	return sessions, err
+}
+
+// RevokeSession ends a session of the user and revokes its refresh tokens.
+// Returns ErrNotExists or ErrNotOwner otherwise.
+func (db *DB) RevokeSession(id string, userID int) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.RevokeSession(id, userID)
+	})
+}
+
+// RevokeAllSessions ends every session of the user and bumps the user's
+// TokenVersion, so access tokens issued so far are no longer accepted.
+// Returns how many sessions were ended.
+func (db *DB) RevokeAllSessions(userID int) (revoked int, err error) {
+	err = db.Update(func(tx *Tx) error {
+		revoked, err = tx.RevokeAllSessions(userID)
+		return err
+	})
+	return revoked, err
+}
+
+func (tx *Tx) CreateSession(userID int, client Client, tokens SessionTokens) (Session, error) {
+	if user, exists := tx.data.Users[userID]; !exists || user.Deleted() {
+		return Session{}, ErrNotExists
+	}
+	if _, exists := tx.data.RefreshTokens[tokens.RefreshTokenHash]; exists {
+		return Session{}, ErrAlreadyExists
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		return Session{}, err
+	}
+
+	now := time.Now().UTC()
+	session := Session{
+		ID:              id,
+		UserID:          userID,
+		CreatedAt:       now,
+		LastUsedAt:      now,
+		ExpiresAt:       tokens.RefreshExpiresAt.UTC(),
+		UserAgent:       client.UserAgent,
+		IP:              client.IP,
+		AccessTokenID:   tokens.AccessTokenID,
+		AccessExpiresAt: tokens.AccessExpiresAt.UTC(),
+	}
+	token := RefreshToken{
+		Hash:      tokens.RefreshTokenHash,
+		UserID:    userID,
+		Family:    id,
+		CreatedAt: now,
+		ExpiresAt: tokens.RefreshExpiresAt.UTC(),
+	}
+	err = tx.apply(putSession(session), putRefreshToken(token))
+	if err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+func (tx *Tx) GetSessions(userID int) ([]Session, error) {
+	now := time.Now().UTC()
+	sessions := []Session{}
+	for _, session := range tx.data.Sessions {
+		if session.UserID == userID && session.Active(now) {
+			sessions = append(sessions, session)
+		}
+	}
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+func (tx *Tx) RevokeSession(id string, userID int) error {
+	session, exists := tx.data.Sessions[id]
+	if !exists || !session.Active(time.Now().UTC()) {
+		return ErrNotExists
+	}
+	if session.UserID != userID {
+		return ErrNotOwner
+	}
+	return tx.revokeSession(id)
+}
+
+func (tx *Tx) RevokeAllSessions(userID int) (int, error) {
+	user, exists := tx.data.Users[userID]
+	if !exists || user.Deleted() {
+		return 0, ErrNotExists
+	}
+
+	revoked, err := tx.revokeSessionsExcept(userID, "")
+	if err != nil {
+		return 0, err
+	}
+
+	user.TokenVersion++
+	user.UpdatedAt = time.Now().UTC()
+	err = tx.apply(putUser(user))
+	if err != nil {
+		return 0, err
+	}
+
+	tx.publish(UserUpdated{User: user})
+	return revoked, nil
+}
+
+// revokeSessionsExcept revokes the active sessions of the user other than keep
+// and returns how many it revoked
+func (tx *Tx) revokeSessionsExcept(userID int, keep string) (int, error) {
+	now := time.Now().UTC()
+	revoked := 0
+	for _, session := range tx.data.Sessions {
+		if session.UserID != userID || session.ID == keep || !session.Active(now) {
+			continue
+		}
+		err := tx.revokeSession(session.ID)
+		if err != nil {
+			return 0, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+// revokeSession marks the session and all its refresh tokens as revoked
+// and denies its newest access token
+func (tx *Tx) revokeSession(id string) error {
+	now := time.Now().UTC()
+	if session, exists := tx.data.Sessions[id]; exists && session.RevokedAt == nil {
+		session.RevokedAt = &now
+		err := tx.apply(putSession(session))
+		if err != nil {
+			return err
+		}
+
+		if session.AccessTokenID != "" && session.AccessExpiresAt.After(now) {
+			err = tx.AddRevokedToken(session.AccessTokenID, session.AccessExpiresAt)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, token := range tx.data.RefreshTokens {
+		if token.Family != id || token.RevokedAt != nil {
+			continue
+		}
+		token.RevokedAt = &now
+		err := tx.apply(putRefreshToken(token))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRevokeAllSessionsDeniesAccessTokens(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user := mustCreateUser(t, store, "a@example.com")
+			for _, hash := range []string{"phone", "laptop"} {
+				_, err := store.CreateSession(user.ID, Client{}, testTokens(hash))
+				if err != nil {
+					t.Fatalf("CreateSession: %v", err)
+				}
+			}
+
+			revoked, err := store.RevokeAllSessions(user.ID)
+			if err != nil {
+				t.Fatalf("RevokeAllSessions: %v", err)
+			}
+			if revoked != 2 {
+				t.Errorf("RevokeAllSessions() = %d, want 2", revoked)
+			}
+			for _, jti := range []string{"jti-phone", "jti-laptop"} {
+				denied, err := store.IsTokenRevoked(jti)
+				if err != nil {
+					t.Fatalf("IsTokenRevoked: %v", err)
+				}
+				if !denied {
+					t.Errorf("access token %s of a revoked session is still accepted", jti)
+				}
+			}
+			updated, err := store.GetUser(user.ID)
+			if err != nil {
+				t.Fatalf("GetUser: %v", err)
+			}
+			if updated.TokenVersion != user.TokenVersion+1 {
+				t.Errorf("token version = %d, want %d", updated.TokenVersion, user.TokenVersion+1)
+			}
+		})
+	}
+}
+
+func TestRevokeAllSessionsRejectsDeletedUser(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user := mustCreateUser(t, store, "a@example.com")
+			err := store.DeleteUser(user.ID)
+			if err != nil {
+				t.Fatalf("DeleteUser: %v", err)
+			}
+
+			_, err = store.RevokeAllSessions(user.ID)
+			if !errors.Is(err, ErrNotExists) {
+				t.Errorf("RevokeAllSessions of a deleted user = %v, want ErrNotExists", err)
+			}
+		})
+	}
+}
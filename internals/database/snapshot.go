@@ -0,0 +1,103 @@
+package database
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// MaxSnapshotSize is the largest database a snapshot may decompress to,
+// so a small compressed upload can't expand to fill the memory
+const MaxSnapshotSize = 1 << 30
+
+var ErrSnapshotTooLarge = fmt.Errorf("snapshot decompresses to more than %d bytes", MaxSnapshotSize)
+
+// ErrInvalidSnapshot wraps the reasons Restore rejects the content of a snapshot:
+// it can't be decompressed, decoded, decrypted, migrated or fails the integrity check
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// Snapshotter is a Store that can copy out all of its data
+// and replace it with such a copy while it is running
+type Snapshotter interface {
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+var _ Snapshotter = (*DB)(nil)
+
+// SnapshotFileName is the name a snapshot taken at t should be saved under
+func SnapshotFileName(t time.Time) string {
+	return "chirpy-snapshot-" + t.UTC().Format("20060102T150405Z") + ".json.gz"
+}
+
+// Snapshot writes a gzip compressed copy of the whole database to w.
+// The copy is taken at a single point in time; writes are only held
+// back while it is serialized, not while it is written out.
+// It has the layout of a database file, encrypted if the DB is.
+func (db *DB) Snapshot(w io.Writer) error {
+	var content []byte
+	err := db.View(func(tx *Tx) error {
+		var err error
+		content, err = encodeDBFile(*tx.data, db.encryptionKey)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	_, err = gz.Write(content)
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Restore replaces the whole database with a snapshot.
+// The snapshot is checked, migrated and checked for integrity before anything is replaced,
+// so a bad snapshot leaves the database as it was. Problems with the content are
+// wrapped in ErrInvalidSnapshot, one that decompresses to more than MaxSnapshotSize
+// is rejected with ErrSnapshotTooLarge. Writes are held back while the snapshot is decoded.
+// Subscriptions end with ErrDataReplaced.
+func (db *DB) Restore(r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+	content, err := io.ReadAll(io.LimitReader(gz, MaxSnapshotSize+1))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+	if len(content) > MaxSnapshotSize {
+		return ErrSnapshotTooLarge
+	}
+
+	// the key may be rotated until the lock is held
+	err = db.lock()
+	if err != nil {
+		return err
+	}
+	defer db.mux.Unlock()
+
+	data, err := decodeDBFile("snapshot", content, db.encryptionKey)
+	if err == nil {
+		_, err = data.migrate()
+	}
+	if err == nil {
+		err = data.checkIntegrity()
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+	data.buildIndexes()
+
+	err = db.storage.rewrite(data)
+	if err != nil {
+		return err
+	}
+	db.data = data
+	db.feed.endAll(ErrDataReplaced)
+	return nil
+}
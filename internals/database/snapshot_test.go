@@ -0,0 +1,117 @@
+package database
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// gzipped compresses content like a snapshot
+func gzipped(t *testing.T, content string) *bytes.Buffer {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	_, err := gz.Write([]byte(content))
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	return buf
+}
+
+func TestRestoreRejectsInvalidSnapshots(t *testing.T) {
+	tests := []struct {
+		name     string
+		snapshot *bytes.Buffer
+	}{
+		{"not gzip", bytes.NewBufferString("{}")},
+		{"not json", gzipped(t, "not json")},
+		{"newer version", gzipped(t, `{"version": 1000}`)},
+		{"failed integrity check", gzipped(t, `{"users": {"1": {"id": 2, "email": "a@example.com", "password": "hash"}}}`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := NewMemoryDB()
+			mustCreateUser(t, db, "a@example.com")
+
+			err := db.Restore(tt.snapshot)
+			if !errors.Is(err, ErrInvalidSnapshot) {
+				t.Fatalf("Restore() = %v, want ErrInvalidSnapshot", err)
+			}
+			if _, err := db.GetUserByEmail("a@example.com"); err != nil {
+				t.Errorf("data was replaced by an invalid snapshot: %v", err)
+			}
+		})
+	}
+}
+
+func TestRestoreRoundTrip(t *testing.T) {
+	source := NewMemoryDB()
+	user := mustCreateUser(t, source, "a@example.com")
+	_, err := source.CreateChirp(user.ID, "kept")
+	if err != nil {
+		t.Fatalf("CreateChirp: %v", err)
+	}
+	snapshot := &bytes.Buffer{}
+	err = source.Snapshot(snapshot)
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	db := NewMemoryDB()
+	mustCreateUser(t, db, "b@example.com")
+	err = db.Restore(snapshot)
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if _, err := db.GetUserByEmail("b@example.com"); err == nil {
+		t.Errorf("user missing from the snapshot survived the restore: %v", err)
+	}
+	chirps, err := db.GetChirpsByAuthor(user.ID)
+	if err != nil || len(chirps) != 1 || chirps[0].Body != "kept" {
+		t.Errorf("chirps after restore = %+v, %v, want the chirp of the snapshot", chirps, err)
+	}
+}
+
+func TestRestoreDuringKeyRotation(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, encryptionKeySize)
+	db, err := NewDBWithOptions(filepath.Join(t.TempDir(), "database.json"), Options{EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("NewDBWithOptions: %v", err)
+	}
+	defer db.Close()
+	mustCreateUser(t, db, "a@example.com")
+	snapshot := &bytes.Buffer{}
+	err = db.Snapshot(snapshot)
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	// the snapshot is decrypted with the key in use when the restore takes over,
+	// run with -race to see both read the key safely
+	var wg sync.WaitGroup
+	var restoreErr, rotateErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		restoreErr = db.Restore(snapshot)
+	}()
+	go func() {
+		defer wg.Done()
+		rotateErr = db.RotateKey(bytes.Repeat([]byte{2}, encryptionKeySize))
+	}()
+	wg.Wait()
+
+	if rotateErr != nil {
+		t.Fatalf("RotateKey: %v", rotateErr)
+	}
+	if restoreErr != nil && !errors.Is(restoreErr, ErrWrongKey) {
+		t.Errorf("Restore() = %v, want it to succeed or fail for the rotated key", restoreErr)
+	}
+}
@@ -0,0 +1,1123 @@
+package database
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+//go:embed migrations/*.sql
+var sqlMigrations embed.FS
+
+// SQLDB is a Store backed by an embedded SQLite database
+type SQLDB struct {
+	db       *sql.DB
+	migrated []string
+}
+
+var _ Store = (*SQLDB)(nil)
+
+// NewSQLDB opens the SQLite database at path, creating it if needed,
+// and applies all migrations that have not run on it yet
+func NewSQLDB(path string) (*SQLDB, error) {
+	dsn := "file:" + path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return &SQLDB{}, err
+	}
+
+	sqlDB := &SQLDB{db: db}
+	err = sqlDB.migrate()
+	if err != nil {
+		db.Close()
+		return &SQLDB{}, err
+	}
+	return sqlDB, nil
+}
+
+// Close closes the underlying database
+func (s *SQLDB) Close() error {
+	return s.db.Close()
+}
+
+// Migrated returns the names of the migrations run on an existing database when
+// it was opened, with what they changed in the data
+func (s *SQLDB) Migrated() []string {
+	return s.migrated
+}
+
+// sqlMigrationSteps are run in the transaction of the migration file they are keyed by,
+// before its script, for changes plain SQL can't make safely. They return notes on what
+// they changed. Like the files, released steps must not change.
+var sqlMigrationSteps = map[string]func(tx *sql.Tx) ([]string, error){
+	"0002_users_email_nocase.sql": renameSQLEmailCase,
+	"0012_drop_email_renames.sql": reportSQLEmailRenames,
+}
+
+// migrate applies the embedded migrations/NNNN_name.sql files in order.
+// Applied versions are recorded in schema_migrations, each file runs in its own transaction.
+func (s *SQLDB) migrate() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at DATETIME NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	current := 0
+	err = s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	names, err := fs.Glob(sqlMigrations, "migrations/*.sql")
+	if err != nil {
+		return err
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		base := strings.TrimPrefix(name, "migrations/")
+		version, err := strconv.Atoi(strings.SplitN(base, "_", 2)[0])
+		if err != nil {
+			return fmt.Errorf("migration %s: name must start with a version number", base)
+		}
+		if version <= current {
+			continue
+		}
+
+		script, err := sqlMigrations.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		notes, err := s.applyMigration(version, base, string(script))
+		if err != nil {
+			return fmt.Errorf("migration %s: %w", base, err)
+		}
+		// creating a new database is not worth reporting
+		if current == 0 {
+			continue
+		}
+		description := base
+		if len(notes) > 0 {
+			description += " (" + strings.Join(notes, "; ") + ")"
+		}
+		s.migrated = append(s.migrated, description)
+	}
+	return nil
+}
+
+func (s *SQLDB) applyMigration(version int, name, script string) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var notes []string
+	if step, ok := sqlMigrationSteps[name]; ok {
+		notes, err = step(tx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = tx.Exec(script)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+		version, name, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	return notes, tx.Commit()
+}
+
+// renameSQLEmailCase renames users whose email only differs in case from an older
+// user's, which would break the case-insensitive index of 0002. See emailCaseRenames.
+func renameSQLEmailCase(tx *sql.Tx) ([]string, error) {
+	rows, err := tx.Query(`SELECT id, email FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	emails := map[int]string{}
+	for rows.Next() {
+		var id int
+		var email string
+		err = rows.Scan(&id, &email)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+		emails[id] = email
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	notes := []string{}
+	renames := emailCaseRenames(ids, emails)
+	for _, id := range ids {
+		renamed, ok := renames[id]
+		if !ok {
+			continue
+		}
+		_, err = tx.Exec(`UPDATE users SET email = ? WHERE id = ?`, renamed, id)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, fmt.Sprintf("user %d %s is now %s", id, emails[id], renamed))
+	}
+	return notes, nil
+}
+
+// reportSQLEmailRenames notes the renames recorded in email_renames before 0012 drops it
+func reportSQLEmailRenames(tx *sql.Tx) ([]string, error) {
+	rows, err := tx.Query(`SELECT user_id, old_email, new_email FROM email_renames ORDER BY user_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notes := []string{}
+	for rows.Next() {
+		var id int
+		var oldEmail, newEmail string
+		err = rows.Scan(&id, &oldEmail, &newEmail)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, fmt.Sprintf("user %d %s is now %s", id, oldEmail, newEmail))
+	}
+	return notes, rows.Err()
+}
+
+// Columns read by scanUser and scanChirp, in order
+const (
+	userColumns  = `id, email, hashed_password, is_chirpy_red, created_at, updated_at, token_version, deleted_at`
+	chirpColumns = `id, author_id, body, created_at, updated_at, deleted_at`
+)
+
+// scanUser reads a row of userColumns
+func scanUser(row interface{ Scan(...any) error }) (User, error) {
+	user := User{}
+	var createdAt, updatedAt int64
+	var deletedAt sql.NullInt64
+	err := row.Scan(&user.ID, &user.Email, &user.HashedPassword, &user.IsChirpyRed, &createdAt, &updatedAt, &user.TokenVersion, &deletedAt)
+	if err != nil {
+		return User{}, err
+	}
+	user.CreatedAt = fromUnixNano(createdAt)
+	user.UpdatedAt = fromUnixNano(updatedAt)
+	if deletedAt.Valid {
+		t := fromUnixNano(deletedAt.Int64)
+		user.DeletedAt = &t
+	}
+	return user, nil
+}
+
+// scanChirp reads a row of chirpColumns
+func scanChirp(row interface{ Scan(...any) error }) (Chirp, error) {
+	chirp := Chirp{}
+	var createdAt, updatedAt int64
+	var deletedAt sql.NullInt64
+	err := row.Scan(&chirp.Id, &chirp.AuthorID, &chirp.Body, &createdAt, &updatedAt, &deletedAt)
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp.CreatedAt = fromUnixNano(createdAt)
+	chirp.UpdatedAt = fromUnixNano(updatedAt)
+	if deletedAt.Valid {
+		t := fromUnixNano(deletedAt.Int64)
+		chirp.DeletedAt = &t
+	}
+	return chirp, nil
+}
+
+func fromUnixNano(nsec int64) time.Time {
+	return time.Unix(0, nsec).UTC()
+}
+
+func (s *SQLDB) CreateUser(email string, password string) (User, error) {
+	now := time.Now().UTC()
+	result, err := s.db.Exec(`INSERT INTO users (email, hashed_password, created_at, updated_at) VALUES (?, ?, ?, ?)`,
+		email, password, now.UnixNano(), now.UnixNano())
+	if isUniqueViolation(err) {
+		return User{}, ErrAlreadyExists
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+
+	return User{
+		ID:             int(id),
+		Email:          email,
+		HashedPassword: password,
+		IsChirpyRed:    false,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}, nil
+}
+
+func (s *SQLDB) GetUserByEmail(email string) (User, error) {
+	user, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE email = ? COLLATE NOCASE AND deleted_at IS NULL`, email))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, errors.New("user not found")
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (s *SQLDB) GetUser(id int) (User, error) {
+	user, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ? AND deleted_at IS NULL`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotExists
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// UpdateUser changes the email and password of a user.
+// A new password hash bumps the user's TokenVersion and revokes every session
+// of the user except keepSession, the one the change was made with.
+func (s *SQLDB) UpdateUser(id int, email, hashedPassword, keepSession string) (User, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	var oldHashedPassword string
+	err = tx.QueryRow(`SELECT hashed_password FROM users WHERE id = ? AND deleted_at IS NULL`, id).Scan(&oldHashedPassword)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, errors.New("user not found")
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	now := time.Now().UTC()
+	// SET expressions see the row as it was before the update
+	user, err := scanUser(tx.QueryRow(`UPDATE users
+		SET email = ?, hashed_password = ?, updated_at = ?, token_version = token_version + (hashed_password IS NOT ?)
+		WHERE id = ?
+		RETURNING `+userColumns, email, hashedPassword, now.UnixNano(), hashedPassword, id))
+	if isUniqueViolation(err) {
+		return User{}, ErrAlreadyExists
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	if hashedPassword != oldHashedPassword {
+		_, err = revokeSQLSessionsExcept(tx, id, keepSession, now)
+		if err != nil {
+			return User{}, err
+		}
+	}
+	return user, tx.Commit()
+}
+
+func (s *SQLDB) PaintUserRed(userID int) error {
+	result, err := s.db.Exec(`UPDATE users SET is_chirpy_red = 1, updated_at = ? WHERE id = ? AND deleted_at IS NULL`, time.Now().UnixNano(), userID)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrNotExists
+	}
+	return nil
+}
+
+// DeleteUser marks a user as deleted, it is purged by PurgeDeletedUsers later.
+// The user is logged out everywhere and its chirps are deleted with it.
+// Its email stays taken until the user is purged.
+func (s *SQLDB) DeleteUser(id int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	result, err := tx.Exec(`UPDATE users SET deleted_at = ?, token_version = token_version + 1, updated_at = ?
+		WHERE id = ? AND deleted_at IS NULL`, now.UnixNano(), now.UnixNano(), id)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrNotExists
+	}
+
+	_, err = revokeSQLSessionsExcept(tx, id, "", now)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE chirps SET deleted_at = ? WHERE author_id = ? AND deleted_at IS NULL`, now.UnixNano(), id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetDeletedUserByEmail returns the deleted user with email, to check who restores it.
+// Returns ErrNotExists or ErrNotDeleted otherwise.
+func (s *SQLDB) GetDeletedUserByEmail(email string) (User, error) {
+	user, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE email = ? COLLATE NOCASE`, email))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotExists
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if !user.Deleted() {
+		return User{}, ErrNotDeleted
+	}
+	return user, nil
+}
+
+// RestoreUser undeletes a user that was deleted after deletedAfter,
+// together with the chirps that were deleted with it.
+// Returns ErrNotExists, ErrNotDeleted or ErrRestoreExpired otherwise.
+func (s *SQLDB) RestoreUser(id int, deletedAfter time.Time) (User, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotExists
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if !user.Deleted() {
+		return User{}, ErrNotDeleted
+	}
+	if !user.DeletedAt.After(deletedAfter) {
+		return User{}, ErrRestoreExpired
+	}
+
+	_, err = tx.Exec(`UPDATE chirps SET deleted_at = NULL WHERE author_id = ? AND deleted_at = ?`,
+		id, user.DeletedAt.UnixNano())
+	if err != nil {
+		return User{}, err
+	}
+	user, err = scanUser(tx.QueryRow(`UPDATE users SET deleted_at = NULL, updated_at = ? WHERE id = ?
+		RETURNING `+userColumns, time.Now().UnixNano(), id))
+	if err != nil {
+		return User{}, err
+	}
+	return user, tx.Commit()
+}
+
+// PurgeDeletedUsers removes users that were deleted before the given time for good,
+// with their chirps and sessions. Returns how many users were removed.
+func (s *SQLDB) PurgeDeletedUsers(before time.Time) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// everything referencing the users goes first
+	for _, query := range []string{
+		`DELETE FROM chirps WHERE author_id IN (SELECT id FROM users WHERE deleted_at < ?)`,
+		`DELETE FROM refresh_tokens WHERE user_id IN (SELECT id FROM users WHERE deleted_at < ?)`,
+		`DELETE FROM sessions WHERE user_id IN (SELECT id FROM users WHERE deleted_at < ?)`,
+	} {
+		_, err = tx.Exec(query, before.UnixNano())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	result, err := tx.Exec(`DELETE FROM users WHERE deleted_at < ?`, before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	purged, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(purged), tx.Commit()
+}
+
+func (s *SQLDB) CreateChirp(authorID int, body string) (Chirp, error) {
+	now := time.Now().UTC()
+	result, err := s.db.Exec(`INSERT INTO chirps (author_id, body, created_at, updated_at) VALUES (?, ?, ?, ?)`,
+		authorID, body, now.UnixNano(), now.UnixNano())
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return Chirp{
+		Id:        int(id),
+		AuthorID:  authorID,
+		Body:      body,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}, nil
+}
+
+func (s *SQLDB) DeleteChirp(id int) error {
+	_, err := s.db.Exec(`UPDATE chirps SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL`, time.Now().UnixNano(), id)
+	return err
+}
+
+// DeleteChirpByAuthor deletes a chirp only if it belongs to authorID.
+// Returns ErrNotExists or ErrNotOwner otherwise.
+func (s *SQLDB) DeleteChirpByAuthor(id, authorID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	owner := 0
+	err = tx.QueryRow(`SELECT author_id FROM chirps WHERE id = ? AND deleted_at IS NULL`, id).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotExists
+	}
+	if err != nil {
+		return err
+	}
+	if owner != authorID {
+		return ErrNotOwner
+	}
+
+	_, err = tx.Exec(`UPDATE chirps SET deleted_at = ? WHERE id = ?`, time.Now().UnixNano(), id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RestoreChirpByAuthor undeletes a chirp of authorID that was deleted after deletedAfter.
+// Returns ErrNotExists, ErrNotOwner, ErrNotDeleted or ErrRestoreExpired otherwise.
+func (s *SQLDB) RestoreChirpByAuthor(id, authorID int, deletedAfter time.Time) (Chirp, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Chirp{}, err
+	}
+	defer tx.Rollback()
+
+	chirp, err := scanChirp(tx.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrNotExists
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+	if chirp.AuthorID != authorID {
+		return Chirp{}, ErrNotOwner
+	}
+	if !chirp.Deleted() {
+		return Chirp{}, ErrNotDeleted
+	}
+	if !chirp.DeletedAt.After(deletedAfter) {
+		return Chirp{}, ErrRestoreExpired
+	}
+
+	_, err = tx.Exec(`UPDATE chirps SET deleted_at = NULL WHERE id = ?`, id)
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp.DeletedAt = nil
+	return chirp, tx.Commit()
+}
+
+func (s *SQLDB) PurgeDeletedChirps(before time.Time) (int, error) {
+	result, err := s.db.Exec(`DELETE FROM chirps WHERE deleted_at < ?`, before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+
+	purged, err := result.RowsAffected()
+	return int(purged), err
+}
+
+func (s *SQLDB) GetChirps() ([]Chirp, error) {
+	return s.queryChirps(`SELECT ` + chirpColumns + ` FROM chirps WHERE deleted_at IS NULL`)
+}
+
+func (s *SQLDB) GetChirpsByAuthor(authorID int) ([]Chirp, error) {
+	return s.queryChirps(`SELECT `+chirpColumns+` FROM chirps WHERE author_id = ? AND deleted_at IS NULL`, authorID)
+}
+
+// GetChirpsPage returns one page of chirps that are not deleted
+func (s *SQLDB) GetChirpsPage(q ChirpQuery) (ChirpPage, error) {
+	return paginate(q, func(descending bool, after *chirpKey, limit int) ([]Chirp, error) {
+		query := `SELECT ` + chirpColumns + ` FROM chirps WHERE deleted_at IS NULL`
+		args := []any{}
+		if len(q.AuthorIDs) > 0 {
+			query += ` AND author_id IN (` + placeholders(len(q.AuthorIDs)) + `)`
+			for _, id := range q.AuthorIDs {
+				args = append(args, id)
+			}
+		}
+		if len(q.ExcludeAuthorIDs) > 0 {
+			query += ` AND author_id NOT IN (` + placeholders(len(q.ExcludeAuthorIDs)) + `)`
+			for _, id := range q.ExcludeAuthorIDs {
+				args = append(args, id)
+			}
+		}
+		if !q.CreatedAfter.IsZero() {
+			query += ` AND created_at > ?`
+			args = append(args, q.CreatedAfter.UnixNano())
+		}
+		if !q.CreatedBefore.IsZero() {
+			query += ` AND created_at < ?`
+			args = append(args, q.CreatedBefore.UnixNano())
+		}
+
+		direction, comparison := `ASC`, `>`
+		if descending {
+			direction, comparison = `DESC`, `<`
+		}
+		orderBy := `created_at ` + direction + `, id ` + direction
+		if q.OrderBy == OrderByID {
+			orderBy = `id ` + direction
+		}
+		if after != nil && q.OrderBy == OrderByID {
+			query += ` AND id ` + comparison + ` ?`
+			args = append(args, after.ID)
+		} else if after != nil {
+			query += ` AND (created_at, id) ` + comparison + ` (?, ?)`
+			args = append(args, after.CreatedAt.UnixNano(), after.ID)
+		}
+		if q.BodyContains == "" {
+			query += ` ORDER BY ` + orderBy + ` LIMIT ?`
+			args = append(args, limit)
+			return s.queryChirps(query, args...)
+		}
+
+		// SQLite only lowercases ASCII, so the body is matched here like in DB
+		query += ` ORDER BY ` + orderBy
+		return s.queryMatchingChirps(q, limit, query, args...)
+	})
+}
+
+// queryMatchingChirps returns the first limit chirps of the query that q matches
+func (s *SQLDB) queryMatchingChirps(q ChirpQuery, limit int, query string, args ...any) ([]Chirp, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return []Chirp{}, err
+	}
+	defer rows.Close()
+
+	chirps := []Chirp{}
+	for len(chirps) < limit && rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return []Chirp{}, err
+		}
+		if q.matches(chirp) {
+			chirps = append(chirps, chirp)
+		}
+	}
+
+	return chirps, rows.Err()
+}
+
+// placeholders returns n comma separated parameter placeholders
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func (s *SQLDB) queryChirps(query string, args ...any) ([]Chirp, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return []Chirp{}, err
+	}
+	defer rows.Close()
+
+	chirps := []Chirp{}
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return []Chirp{}, err
+		}
+		chirps = append(chirps, chirp)
+	}
+
+	return chirps, rows.Err()
+}
+
+func (s *SQLDB) GetChirp(id int) (Chirp, error) {
+	chirp, err := scanChirp(s.db.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ? AND deleted_at IS NULL`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, errors.New("chirp does not exist")
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+func (s *SQLDB) AddRevokedToken(tokenString string, expiresAt time.Time) error {
+	_, err := s.db.Exec(`INSERT INTO revoked_tokens (token, revoked_at, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (token) DO UPDATE SET revoked_at = excluded.revoked_at, expires_at = excluded.expires_at`,
+		tokenString, time.Now().UTC(), expiresAt.Unix())
+	return err
+}
+
+func (s *SQLDB) IsTokenRevoked(tokenString string) (bool, error) {
+	exists := false
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE token = ?)`, tokenString).
+		Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+// isUniqueViolation reports whether err comes from a UNIQUE or PRIMARY KEY constraint,
+// like a taken email
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	code := sqliteErr.Code()
+	return code == sqlite3.SQLITE_CONSTRAINT_UNIQUE || code == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+}
+
+func (s *SQLDB) PruneRevokedTokens(before time.Time) (int, error) {
+	result, err := s.db.Exec(`DELETE FROM revoked_tokens WHERE expires_at < ?`, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+
+	pruned, err := result.RowsAffected()
+	return int(pruned), err
+}
+
+// Columns read by scanRefreshToken, in order
+const refreshTokenColumns = `hash, user_id, family, created_at, expires_at, used_at, revoked_at`
+
+// scanRefreshToken reads a row of refreshTokenColumns
+func scanRefreshToken(row interface{ Scan(...any) error }) (RefreshToken, error) {
+	token := RefreshToken{}
+	var createdAt, expiresAt int64
+	var usedAt, revokedAt sql.NullInt64
+	err := row.Scan(&token.Hash, &token.UserID, &token.Family, &createdAt, &expiresAt, &usedAt, &revokedAt)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	token.CreatedAt = fromUnixNano(createdAt)
+	token.ExpiresAt = fromUnixNano(expiresAt)
+	if usedAt.Valid {
+		t := fromUnixNano(usedAt.Int64)
+		token.UsedAt = &t
+	}
+	if revokedAt.Valid {
+		t := fromUnixNano(revokedAt.Int64)
+		token.RevokedAt = &t
+	}
+	return token, nil
+}
+
+// RotateRefreshToken replaces the token with hash by the new tokens of its session.
+// Returns ErrNotExists, ErrTokenRevoked or ErrTokenExpired if the token can't be used.
+// Replaying a used token revokes its whole session and returns ErrTokenReused.
+func (s *SQLDB) RotateRefreshToken(hash string, tokens SessionTokens) (RefreshToken, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	defer tx.Rollback()
+
+	old, err := scanRefreshToken(tx.QueryRow(`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE hash = ?`, hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return RefreshToken{}, ErrNotExists
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if old.RevokedAt != nil {
+		return RefreshToken{}, ErrTokenRevoked
+	}
+	now := time.Now().UTC()
+	if old.UsedAt != nil {
+		err = revokeSQLSession(tx, old.Family, now)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			return RefreshToken{}, err
+		}
+		return RefreshToken{}, ErrTokenReused
+	}
+	if !old.ExpiresAt.After(now) {
+		return RefreshToken{}, ErrTokenExpired
+	}
+
+	_, err = tx.Exec(`UPDATE refresh_tokens SET used_at = ? WHERE hash = ?`, now.UnixNano(), hash)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	token := RefreshToken{
+		Hash:      tokens.RefreshTokenHash,
+		UserID:    old.UserID,
+		Family:    old.Family,
+		CreatedAt: now,
+		ExpiresAt: tokens.RefreshExpiresAt.UTC(),
+	}
+	_, err = tx.Exec(`INSERT INTO refresh_tokens (hash, user_id, family, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		token.Hash, token.UserID, token.Family, token.CreatedAt.UnixNano(), token.ExpiresAt.UnixNano())
+	if isUniqueViolation(err) {
+		return RefreshToken{}, ErrAlreadyExists
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	_, err = tx.Exec(`UPDATE sessions SET last_used_at = ?, expires_at = ?, access_token_id = ?, access_expires_at = ?
+		WHERE id = ?`,
+		now.UnixNano(), token.ExpiresAt.UnixNano(), tokens.AccessTokenID, tokens.AccessExpiresAt.UnixNano(), token.Family)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	return token, tx.Commit()
+}
+
+// RevokeRefreshToken revokes the token with hash and the rest of its session
+func (s *SQLDB) RevokeRefreshToken(hash string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	family := ""
+	err = tx.QueryRow(`SELECT family FROM refresh_tokens WHERE hash = ?`, hash).Scan(&family)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotExists
+	}
+	if err != nil {
+		return err
+	}
+
+	err = revokeSQLSession(tx, family, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ExchangeLegacyRefreshToken revokes a refresh token from before they were opaque
+// and starts a session of its user in its place, in one transaction.
+// Returns ErrTokenRevoked if the token was revoked or exchanged before.
+func (s *SQLDB) ExchangeLegacyRefreshToken(tokenString string, expiresAt time.Time, userID int, client Client, tokens SessionTokens) (Session, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Session{}, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO revoked_tokens (token, revoked_at, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (token) DO NOTHING`,
+		tokenString, time.Now().UTC(), expiresAt.Unix())
+	if err != nil {
+		return Session{}, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return Session{}, err
+	}
+	if inserted == 0 {
+		return Session{}, ErrTokenRevoked
+	}
+
+	session, err := createSQLSession(tx, userID, client, tokens)
+	if err != nil {
+		return Session{}, err
+	}
+	return session, tx.Commit()
+}
+
+// PruneRefreshTokens deletes refresh tokens and sessions that expired before the given time.
+// Returns how many refresh tokens were deleted.
+func (s *SQLDB) PruneRefreshTokens(before time.Time) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM refresh_tokens WHERE expires_at < ?`, before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	pruned, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`DELETE FROM sessions WHERE expires_at < ?`, before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return int(pruned), tx.Commit()
+}
+
+// Columns read by scanSession, in order
+const sessionColumns = `id, user_id, created_at, last_used_at, expires_at, user_agent, ip, revoked_at,
+	access_token_id, access_expires_at`
+
+// scanSession reads a row of sessionColumns
+func scanSession(row interface{ Scan(...any) error }) (Session, error) {
+	session := Session{}
+	var createdAt, lastUsedAt, expiresAt, accessExpiresAt int64
+	var revokedAt sql.NullInt64
+	err := row.Scan(&session.ID, &session.UserID, &createdAt, &lastUsedAt, &expiresAt,
+		&session.UserAgent, &session.IP, &revokedAt, &session.AccessTokenID, &accessExpiresAt)
+	if err != nil {
+		return Session{}, err
+	}
+	session.CreatedAt = fromUnixNano(createdAt)
+	session.LastUsedAt = fromUnixNano(lastUsedAt)
+	session.ExpiresAt = fromUnixNano(expiresAt)
+	session.AccessExpiresAt = fromUnixNano(accessExpiresAt)
+	if revokedAt.Valid {
+		t := fromUnixNano(revokedAt.Int64)
+		session.RevokedAt = &t
+	}
+	return session, nil
+}
+
+// CreateSession starts a session of the user with its first refresh token
+func (s *SQLDB) CreateSession(userID int, client Client, tokens SessionTokens) (Session, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Session{}, err
+	}
+	defer tx.Rollback()
+
+	session, err := createSQLSession(tx, userID, client, tokens)
+	if err != nil {
+		return Session{}, err
+	}
+	return session, tx.Commit()
+}
+
+// createSQLSession starts a session of the user with its first refresh token
+func createSQLSession(tx *sql.Tx, userID int, client Client, tokens SessionTokens) (Session, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return Session{}, err
+	}
+
+	now := time.Now().UTC()
+	session := Session{
+		ID:              id,
+		UserID:          userID,
+		CreatedAt:       now,
+		LastUsedAt:      now,
+		ExpiresAt:       tokens.RefreshExpiresAt.UTC(),
+		UserAgent:       client.UserAgent,
+		IP:              client.IP,
+		AccessTokenID:   tokens.AccessTokenID,
+		AccessExpiresAt: tokens.AccessExpiresAt.UTC(),
+	}
+
+	active := 0
+	err = tx.QueryRow(`SELECT COUNT(*) FROM users WHERE id = ? AND deleted_at IS NULL`, userID).Scan(&active)
+	if err != nil {
+		return Session{}, err
+	}
+	if active == 0 {
+		return Session{}, ErrNotExists
+	}
+
+	_, err = tx.Exec(`INSERT INTO sessions
+		(id, user_id, created_at, last_used_at, expires_at, user_agent, ip, access_token_id, access_expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		session.ID, session.UserID, now.UnixNano(), now.UnixNano(), session.ExpiresAt.UnixNano(),
+		session.UserAgent, session.IP, session.AccessTokenID, session.AccessExpiresAt.UnixNano())
+	if err != nil {
+		return Session{}, err
+	}
+	_, err = tx.Exec(`INSERT INTO refresh_tokens (hash, user_id, family, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		tokens.RefreshTokenHash, userID, session.ID, now.UnixNano(), session.ExpiresAt.UnixNano())
+	if isUniqueViolation(err) {
+		return Session{}, ErrAlreadyExists
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+// GetSessions returns the active sessions of the user, most recently used first
+func (s *SQLDB) GetSessions(userID int) ([]Session, error) {
+	rows, err := s.db.Query(`SELECT `+sessionColumns+` FROM sessions
+		WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ?`, userID, time.Now().UnixNano())
+	if err != nil {
+		return []Session{}, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return []Session{}, err
+		}
+		sessions = append(sessions, session)
+	}
+	sortSessions(sessions)
+	return sessions, rows.Err()
+}
+
+// RevokeSession ends a session of the user and revokes its refresh tokens.
+// Returns ErrNotExists or ErrNotOwner otherwise.
+func (s *SQLDB) RevokeSession(id string, userID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	session, err := scanSession(tx.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !session.Active(now)) {
+		return ErrNotExists
+	}
+	if err != nil {
+		return err
+	}
+	if session.UserID != userID {
+		return ErrNotOwner
+	}
+
+	err = revokeSQLSession(tx, id, now)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RevokeAllSessions ends every session of the user and bumps the user's
+// TokenVersion, so access tokens issued so far are no longer accepted.
+// Returns how many sessions were ended.
+func (s *SQLDB) RevokeAllSessions(userID int) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	result, err := tx.Exec(`UPDATE users SET token_version = token_version + 1, updated_at = ? WHERE id = ? AND deleted_at IS NULL`,
+		now.UnixNano(), userID)
+	if err != nil {
+		return 0, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if updated == 0 {
+		return 0, ErrNotExists
+	}
+
+	revoked, err := revokeSQLSessionsExcept(tx, userID, "", now)
+	if err != nil {
+		return 0, err
+	}
+	return revoked, tx.Commit()
+}
+
+// revokeSQLSessionsExcept revokes the active sessions of the user other than keep
+// and returns how many it revoked
+func revokeSQLSessionsExcept(tx *sql.Tx, userID int, keep string, now time.Time) (int, error) {
+	rows, err := tx.Query(`SELECT id FROM sessions WHERE user_id = ? AND id != ? AND revoked_at IS NULL AND expires_at > ?`,
+		userID, keep, now.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		err = revokeSQLSession(tx, id, now)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), nil
+}
+
+// revokeSQLSession marks the session and all its refresh tokens as revoked
+// and denies its newest access token
+func revokeSQLSession(tx *sql.Tx, id string, now time.Time) error {
+	// revoked_tokens.expires_at is in seconds, rounded up to cover the whole expiry
+	_, err := tx.Exec(`INSERT INTO revoked_tokens (token, revoked_at, expires_at)
+		SELECT access_token_id, ?, (access_expires_at + 999999999) / 1000000000 FROM sessions
+		WHERE id = ? AND revoked_at IS NULL AND access_token_id != '' AND access_expires_at > ?
+		ON CONFLICT (token) DO NOTHING`,
+		now, id, now.UnixNano())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`, now.UnixNano(), id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE refresh_tokens SET revoked_at = ? WHERE family = ? AND revoked_at IS NULL`, now.UnixNano(), id)
+	return err
+}
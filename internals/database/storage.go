@@ -0,0 +1,187 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// storage is where a DB persists its DBStructure.
+// load is called when the DB is opened, write after every change.
+type storage interface {
+	load() (DBStructure, error)
+	write(data DBStructure, changes []change) error
+	// rewrite replaces everything in storage with data
+	rewrite(data DBStructure) error
+	// backup copies the storage files aside, adding suffix to their names
+	backup(suffix string) error
+	close() error
+}
+
+// watchedStorage is a storage that other programs can edit behind our back
+type watchedStorage interface {
+	storage
+	changed() (bool, error)
+}
+
+// keyedStorage is a storage that can encrypt its files
+type keyedStorage interface {
+	storage
+	rotateKey(data DBStructure, newKey []byte) error
+}
+
+// fileStorage keeps the whole DBStructure in a single JSON file
+type fileStorage struct {
+	path      string
+	key       []byte
+	modTime   time.Time
+	size      int64
+	recovered error
+}
+
+// ensureDB creates a new database file if neither it nor a backup exists
+func (fs *fileStorage) ensureDB() error {
+	if dbFileExists(fs.path, backupGenerations) {
+		return nil
+	}
+
+	return fs.write(newDBStructure(), nil)
+}
+
+// load reads the database file into memory.
+// A corrupt file is set aside as path.corrupt and replaced by the newest good backup.
+func (fs *fileStorage) load() (DBStructure, error) {
+	data, recovered, err := loadDBFile(fs.path, backupGenerations, fs.key)
+	if err != nil {
+		return data, err
+	}
+
+	if recovered != nil {
+		fs.recovered = recovered
+		err = os.Rename(fs.path, fs.path+".corrupt")
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return data, err
+		}
+		content, err := encodeDBFile(data, fs.key)
+		if err != nil {
+			return data, err
+		}
+		err = writeFileAtomic(fs.path, content, 0)
+		if err != nil {
+			return data, err
+		}
+	}
+
+	return data, fs.remember()
+}
+
+// write atomically replaces the database file on disk
+func (fs *fileStorage) write(dbStructure DBStructure, _ []change) error {
+	content, err := encodeDBFile(dbStructure, fs.key)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(fs.path, content, backupGenerations)
+	if err != nil {
+		return err
+	}
+
+	return fs.remember()
+}
+
+func (fs *fileStorage) rewrite(dbStructure DBStructure) error {
+	return fs.write(dbStructure, nil)
+}
+
+// rotateKey writes the file and all its backup generations encrypted with newKey.
+// With a nil newKey they are written unencrypted.
+// Once the file is written the storage stays on newKey, even if a backup can't be rotated.
+func (fs *fileStorage) rotateKey(data DBStructure, newKey []byte) error {
+	oldKey := fs.key
+	fs.key = newKey
+	err := fs.write(data, nil)
+	if err != nil {
+		fs.key = oldKey
+		return err
+	}
+
+	for n := 1; n <= backupGenerations; n++ {
+		path := backupPath(fs.path, n)
+		backup, err := readDBFile(path, oldKey)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			// already rotated by an earlier, interrupted rotation
+			backup, err = readDBFile(path, newKey)
+		}
+		if err != nil {
+			// left unencrypted from before the database was first encrypted
+			backup, err = readDBFile(path, nil)
+		}
+		if err == nil {
+			var content []byte
+			content, err = encodeDBFile(backup, newKey)
+			if err == nil {
+				err = writeFileAtomic(path, content, 0)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%w: backup %s: %w", ErrRotationIncomplete, path, err)
+		}
+	}
+	return nil
+}
+
+func (fs *fileStorage) close() error {
+	return nil
+}
+
+func (fs *fileStorage) backup(suffix string) error {
+	return copyFile(fs.path, fs.path+suffix)
+}
+
+// remember notes the state of the file as we last saw it
+func (fs *fileStorage) remember() error {
+	info, err := os.Stat(fs.path)
+	if err != nil {
+		return err
+	}
+	fs.modTime = info.ModTime()
+	fs.size = info.Size()
+	return nil
+}
+
+// changed reports whether the file differs from the one we last loaded or wrote
+func (fs *fileStorage) changed() (bool, error) {
+	info, err := os.Stat(fs.path)
+	if err != nil {
+		return false, err
+	}
+	return !info.ModTime().Equal(fs.modTime) || info.Size() != fs.size, nil
+}
+
+// memoryStorage keeps nothing, the data lives only in the DB
+type memoryStorage struct{}
+
+func (memoryStorage) load() (DBStructure, error) {
+	return newDBStructure(), nil
+}
+
+func (memoryStorage) write(DBStructure, []change) error {
+	return nil
+}
+
+func (memoryStorage) rewrite(DBStructure) error {
+	return nil
+}
+
+func (memoryStorage) backup(string) error {
+	return nil
+}
+
+func (memoryStorage) close() error {
+	return nil
+}
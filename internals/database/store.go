@@ -0,0 +1,43 @@
+package database
+
+import "time"
+
+// Store is the set of operations the API handlers need from a storage backend.
+type Store interface {
+	CreateUser(email string, password string) (User, error)
+	GetUser(id int) (User, error)
+	GetUserByEmail(email string) (User, error)
+	UpdateUser(id int, email, hashedPassword, keepSession string) (User, error)
+	PaintUserRed(userID int) error
+	DeleteUser(id int) error
+	GetDeletedUserByEmail(email string) (User, error)
+	RestoreUser(id int, deletedAfter time.Time) (User, error)
+	PurgeDeletedUsers(before time.Time) (int, error)
+
+	CreateChirp(authorID int, body string) (Chirp, error)
+	DeleteChirp(id int) error
+	DeleteChirpByAuthor(id, authorID int) error
+	RestoreChirpByAuthor(id, authorID int, deletedAfter time.Time) (Chirp, error)
+	PurgeDeletedChirps(before time.Time) (int, error)
+	GetChirps() ([]Chirp, error)
+	GetChirpsByAuthor(authorID int) ([]Chirp, error)
+	GetChirpsPage(q ChirpQuery) (ChirpPage, error)
+	GetChirp(id int) (Chirp, error)
+
+	AddRevokedToken(tokenString string, expiresAt time.Time) error
+	IsTokenRevoked(tokenString string) (bool, error)
+	PruneRevokedTokens(before time.Time) (int, error)
+
+	CreateSession(userID int, client Client, tokens SessionTokens) (Session, error)
+	GetSessions(userID int) ([]Session, error)
+	RevokeSession(id string, userID int) error
+	RevokeAllSessions(userID int) (int, error)
+	RotateRefreshToken(hash string, tokens SessionTokens) (RefreshToken, error)
+	ExchangeLegacyRefreshToken(tokenString string, expiresAt time.Time, userID int, client Client, tokens SessionTokens) (Session, error)
+	RevokeRefreshToken(hash string) error
+	PruneRefreshTokens(before time.Time) (int, error)
+
+	Close() error
+}
+
+var _ Store = (*DB)(nil)
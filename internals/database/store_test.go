@@ -0,0 +1,48 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// testStores returns an empty store of every backend, closed when the test ends
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	dir := t.TempDir()
+
+	fileDB, err := NewDB(filepath.Join(dir, "database.json"))
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	logDB, err := NewLogDB(filepath.Join(dir, "log.json"))
+	if err != nil {
+		t.Fatalf("NewLogDB: %v", err)
+	}
+	sqlDB, err := NewSQLDB(filepath.Join(dir, "database.sqlite"))
+	if err != nil {
+		t.Fatalf("NewSQLDB: %v", err)
+	}
+
+	stores := map[string]Store{
+		"memory": NewMemoryDB(),
+		"json":   fileDB,
+		"wal":    logDB,
+		"sqlite": sqlDB,
+	}
+	t.Cleanup(func() {
+		for _, store := range stores {
+			store.Close()
+		}
+	})
+	return stores
+}
+
+// mustCreateUser creates a user or fails the test
+func mustCreateUser(t *testing.T, store Store, email string) User {
+	t.Helper()
+	user, err := store.CreateUser(email, "hash")
+	if err != nil {
+		t.Fatalf("CreateUser(%q): %v", email, err)
+	}
+	return user
+}
@@ -0,0 +1,536 @@
+package database
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Format is a file format the data can be exported to and imported from
+type Format string
+
+const (
+	FormatNDJSON Format = "ndjson"
+	FormatCSV    Format = "csv"
+)
+
+func ParseFormat(format string) (Format, error) {
+	switch Format(format) {
+	case FormatNDJSON, FormatCSV:
+		return Format(format), nil
+	}
+	return "", fmt.Errorf("unknown format %q", format)
+}
+
+// ConflictPolicy decides what an import does with a user
+// whose email is already taken
+type ConflictPolicy int
+
+const (
+	// ConflictFail stops the import and leaves the database as it was
+	ConflictFail ConflictPolicy = iota
+	// ConflictSkip keeps the existing user and leaves out the imported chirps of
+	// the user, they are not added to the account of someone else
+	ConflictSkip
+	// ConflictOverwrite replaces the password and membership of the existing user.
+	// A different password logs the user out like a password change does.
+	ConflictOverwrite
+)
+
+func ParseConflictPolicy(policy string) (ConflictPolicy, error) {
+	switch policy {
+	case "fail":
+		return ConflictFail, nil
+	case "skip":
+		return ConflictSkip, nil
+	case "overwrite":
+		return ConflictOverwrite, nil
+	}
+	return ConflictFail, fmt.Errorf("unknown conflict policy %q", policy)
+}
+
+const collectionRevokedTokens = "revoked_tokens"
+
+// Progress is reported every progressEvery records
+const progressEvery = 1000
+
+// TransferReport counts the records an export or import went through so far
+type TransferReport struct {
+	Users         int
+	Chirps        int
+	RevokedTokens int
+	// Users whose email was taken, left alone or overwritten by an import
+	Skipped     int
+	Overwritten int
+	// Chirps of skipped users, which are not imported
+	SkippedChirps int
+}
+
+// TransferFileName is the name of the file a collection is exported to
+func TransferFileName(collection string, format Format) string {
+	return collection + "." + string(format)
+}
+
+// Export writes users, chirps and revoked tokens to one file each in dir,
+// ordered by ID. The data is copied at a single point in time.
+// progress, if not nil, is called as records are written.
+func (db *DB) Export(dir string, format Format, progress func(TransferReport)) (TransferReport, error) {
+	var users []User
+	var chirps []Chirp
+	var tokens []RevokedToken
+	err := db.View(func(tx *Tx) error {
+		users = sortedValues(tx.data.Users, func(user User) int { return user.ID })
+		chirps = sortedValues(tx.data.Chirps, func(chirp Chirp) int { return chirp.Id })
+		tokens = make([]RevokedToken, 0, len(tx.data.RevokedTokens))
+		for _, token := range tx.data.RevokedTokens {
+			tokens = append(tokens, token)
+		}
+		slices.SortFunc(tokens, func(a, b RevokedToken) int { return a.RevokedAt.Compare(b.RevokedAt) })
+		return nil
+	})
+	if err != nil {
+		return TransferReport{}, err
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return TransferReport{}, err
+	}
+
+	report := TransferReport{}
+	tick := func(count *int) {
+		*count++
+		if progress != nil && *count%progressEvery == 0 {
+			progress(report)
+		}
+	}
+
+	err = exportFile(dir, collectionUsers, format, userCodec, users, func() { tick(&report.Users) })
+	if err == nil {
+		err = exportFile(dir, collectionChirps, format, chirpCodec, chirps, func() { tick(&report.Chirps) })
+	}
+	if err == nil {
+		err = exportFile(dir, collectionRevokedTokens, format, revokedTokenCodec, tokens, func() { tick(&report.RevokedTokens) })
+	}
+	if err != nil {
+		return report, err
+	}
+	if progress != nil {
+		progress(report)
+	}
+	return report, nil
+}
+
+// ImportOptions tune how Import treats the data it reads
+type ImportOptions struct {
+	Format     Format
+	OnConflict ConflictPolicy
+	// Progress, if not nil, is called as records are imported
+	Progress func(TransferReport)
+}
+
+// Import reads the files written by Export from dir and adds their records to the database.
+// Missing files are treated as empty. Users and chirps get new IDs and chirps
+// follow their author to its new ID. Everything is imported in one transaction,
+// so a failed import leaves the database as it was.
+func (db *DB) Import(dir string, opts ImportOptions) (TransferReport, error) {
+	var users []User
+	var chirps []Chirp
+	var tokens []RevokedToken
+	err := importFile(dir, collectionUsers, opts.Format, userCodec, &users)
+	if err == nil {
+		err = importFile(dir, collectionChirps, opts.Format, chirpCodec, &chirps)
+	}
+	if err == nil {
+		err = importFile(dir, collectionRevokedTokens, opts.Format, revokedTokenCodec, &tokens)
+	}
+	if err != nil {
+		return TransferReport{}, err
+	}
+
+	var report TransferReport
+	err = db.Update(func(tx *Tx) error {
+		report = TransferReport{}
+		return tx.importRecords(users, chirps, tokens, opts, &report)
+	})
+	if err != nil {
+		return TransferReport{}, err
+	}
+	if opts.Progress != nil {
+		opts.Progress(report)
+	}
+	return report, nil
+}
+
+func (tx *Tx) importRecords(users []User, chirps []Chirp, tokens []RevokedToken, opts ImportOptions, report *TransferReport) error {
+	tick := func() {
+		done := report.Users + report.Skipped + report.Overwritten + report.Chirps + report.SkippedChirps + report.RevokedTokens
+		if opts.Progress != nil && done%progressEvery == 0 {
+			opts.Progress(*report)
+		}
+	}
+
+	// imported user ID -> ID in this database
+	userIDs := make(map[int]int, len(users))
+	// imported IDs of users that were skipped
+	skipped := map[int]bool{}
+	for _, user := range users {
+		if _, seen := userIDs[user.ID]; seen || skipped[user.ID] {
+			return fmt.Errorf("user %d is imported twice", user.ID)
+		}
+		if user.Email == "" {
+			return fmt.Errorf("user %d has no email", user.ID)
+		}
+
+		importedID := user.ID
+		stampTimes(&user.CreatedAt, &user.UpdatedAt)
+		existing, exists := tx.data.userByEmail(user.Email)
+		switch {
+		case !exists:
+			user.ID = tx.data.nextID(collectionUsers)
+			report.Users++
+		case opts.OnConflict == ConflictSkip:
+			skipped[importedID] = true
+			report.Skipped++
+			tick()
+			continue
+		case opts.OnConflict == ConflictOverwrite:
+			// an imported version must not accept tokens the existing user already rejects
+			user.ID = existing.ID
+			user.CreatedAt = existing.CreatedAt
+			user.TokenVersion = existing.TokenVersion
+			if user.HashedPassword != existing.HashedPassword {
+				user.TokenVersion++
+				_, err := tx.revokeSessionsExcept(existing.ID, "")
+				if err != nil {
+					return err
+				}
+			}
+			report.Overwritten++
+		default:
+			return fmt.Errorf("user %d with email %s: %w", importedID, user.Email, ErrAlreadyExists)
+		}
+
+		err := tx.apply(putUser(user))
+		if err != nil {
+			return err
+		}
+		if exists {
+			tx.publish(UserUpdated{User: user})
+		} else {
+			tx.publish(UserCreated{User: user})
+		}
+		userIDs[importedID] = user.ID
+		tick()
+	}
+
+	for _, chirp := range chirps {
+		if skipped[chirp.AuthorID] {
+			report.SkippedChirps++
+			tick()
+			continue
+		}
+		authorID, ok := userIDs[chirp.AuthorID]
+		if !ok {
+			return fmt.Errorf("chirp %d: author %d is not imported: %w", chirp.Id, chirp.AuthorID, ErrNotExists)
+		}
+		chirp.Id = tx.data.nextID(collectionChirps)
+		chirp.AuthorID = authorID
+		stampTimes(&chirp.CreatedAt, &chirp.UpdatedAt)
+
+		err := tx.apply(putChirp(chirp))
+		if err != nil {
+			return err
+		}
+		if !chirp.Deleted() {
+			tx.publish(ChirpCreated{Chirp: chirp})
+		}
+		report.Chirps++
+		tick()
+	}
+
+	for _, token := range tokens {
+		if _, exists := tx.data.RevokedTokens[token.Token]; exists {
+			continue
+		}
+		err := tx.apply(putRevokedToken(token))
+		if err != nil {
+			return err
+		}
+		tx.publish(TokenRevoked{Token: token})
+		report.RevokedTokens++
+		tick()
+	}
+	return nil
+}
+
+// stampTimes fills in timestamps missing from imported records with the current time
+func stampTimes(createdAt, updatedAt *time.Time) {
+	now := time.Now().UTC()
+	if createdAt.IsZero() {
+		*createdAt = now
+	}
+	if updatedAt.IsZero() {
+		*updatedAt = *createdAt
+	}
+}
+
+// codec turns records of one collection into CSV rows and back.
+// NDJSON uses the JSON form of the records, same as the database file.
+type codec[T any] struct {
+	header  []string
+	toRow   func(T) []string
+	fromRow func([]string) (T, error)
+}
+
+var userCodec = codec[User]{
+	header: []string{"id", "email", "password", "is_chirpy_red", "created_at", "updated_at", "token_version", "deleted_at"},
+	toRow: func(user User) []string {
+		deletedAt := ""
+		if user.Deleted() {
+			deletedAt = formatTime(*user.DeletedAt)
+		}
+		return []string{strconv.Itoa(user.ID), user.Email, user.HashedPassword, strconv.FormatBool(user.IsChirpyRed),
+			formatTime(user.CreatedAt), formatTime(user.UpdatedAt), strconv.Itoa(user.TokenVersion), deletedAt}
+	},
+	fromRow: func(row []string) (User, error) {
+		id, err := strconv.Atoi(row[0])
+		if err != nil {
+			return User{}, fmt.Errorf("id: %w", err)
+		}
+		isChirpyRed, err := strconv.ParseBool(row[3])
+		if err != nil {
+			return User{}, fmt.Errorf("is_chirpy_red: %w", err)
+		}
+		createdAt, err := parseTime(row[4])
+		if err != nil {
+			return User{}, fmt.Errorf("created_at: %w", err)
+		}
+		updatedAt, err := parseTime(row[5])
+		if err != nil {
+			return User{}, fmt.Errorf("updated_at: %w", err)
+		}
+		tokenVersion, err := strconv.Atoi(row[6])
+		if err != nil {
+			return User{}, fmt.Errorf("token_version: %w", err)
+		}
+		user := User{ID: id, Email: row[1], HashedPassword: row[2], IsChirpyRed: isChirpyRed,
+			CreatedAt: createdAt, UpdatedAt: updatedAt, TokenVersion: tokenVersion}
+		if row[7] != "" {
+			deletedAt, err := parseTime(row[7])
+			if err != nil {
+				return User{}, fmt.Errorf("deleted_at: %w", err)
+			}
+			user.DeletedAt = &deletedAt
+		}
+		return user, nil
+	},
+}
+
+var chirpCodec = codec[Chirp]{
+	header: []string{"id", "author_id", "body", "created_at", "updated_at", "deleted_at"},
+	toRow: func(chirp Chirp) []string {
+		deletedAt := ""
+		if chirp.Deleted() {
+			deletedAt = formatTime(*chirp.DeletedAt)
+		}
+		return []string{strconv.Itoa(chirp.Id), strconv.Itoa(chirp.AuthorID), chirp.Body,
+			formatTime(chirp.CreatedAt), formatTime(chirp.UpdatedAt), deletedAt}
+	},
+	fromRow: func(row []string) (Chirp, error) {
+		id, err := strconv.Atoi(row[0])
+		if err != nil {
+			return Chirp{}, fmt.Errorf("id: %w", err)
+		}
+		authorID, err := strconv.Atoi(row[1])
+		if err != nil {
+			return Chirp{}, fmt.Errorf("author_id: %w", err)
+		}
+		createdAt, err := parseTime(row[3])
+		if err != nil {
+			return Chirp{}, fmt.Errorf("created_at: %w", err)
+		}
+		updatedAt, err := parseTime(row[4])
+		if err != nil {
+			return Chirp{}, fmt.Errorf("updated_at: %w", err)
+		}
+		chirp := Chirp{Id: id, AuthorID: authorID, Body: row[2], CreatedAt: createdAt, UpdatedAt: updatedAt}
+		if row[5] != "" {
+			deletedAt, err := parseTime(row[5])
+			if err != nil {
+				return Chirp{}, fmt.Errorf("deleted_at: %w", err)
+			}
+			chirp.DeletedAt = &deletedAt
+		}
+		return chirp, nil
+	},
+}
+
+var revokedTokenCodec = codec[RevokedToken]{
+	header: []string{"token", "revoked_at", "expires_at"},
+	toRow: func(token RevokedToken) []string {
+		return []string{token.Token, formatTime(token.RevokedAt), formatTime(token.ExpiresAt)}
+	},
+	fromRow: func(row []string) (RevokedToken, error) {
+		revokedAt, err := parseTime(row[1])
+		if err != nil {
+			return RevokedToken{}, fmt.Errorf("revoked_at: %w", err)
+		}
+		expiresAt, err := parseTime(row[2])
+		if err != nil {
+			return RevokedToken{}, fmt.Errorf("expires_at: %w", err)
+		}
+		return RevokedToken{Token: row[0], RevokedAt: revokedAt, ExpiresAt: expiresAt}, nil
+	},
+}
+
+func exportFile[T any](dir, collection string, format Format, c codec[T], records []T, written func()) error {
+	// the files hold password hashes, dir may be readable by others
+	file, err := os.OpenFile(filepath.Join(dir, TransferFileName(collection, format)), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	// a file left by an earlier export keeps its mode
+	err = file.Chmod(0600)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w := bufio.NewWriter(file)
+
+	err = writeRecords(w, format, c, records, written)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func writeRecords[T any](w io.Writer, format Format, c codec[T], records []T, written func()) error {
+	switch format {
+	case FormatNDJSON:
+		enc := json.NewEncoder(w)
+		for _, record := range records {
+			err := enc.Encode(record)
+			if err != nil {
+				return err
+			}
+			written()
+		}
+		return nil
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		err := cw.Write(c.header)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			err = cw.Write(c.toRow(record))
+			if err != nil {
+				return err
+			}
+			written()
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+func importFile[T any](dir, collection string, format Format, c codec[T], records *[]T) error {
+	name := TransferFileName(collection, format)
+	file, err := os.Open(filepath.Join(dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	*records, err = readRecords(bufio.NewReader(file), format, c)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+func readRecords[T any](r io.Reader, format Format, c codec[T]) ([]T, error) {
+	records := []T{}
+	switch format {
+	case FormatNDJSON:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 1<<20)
+		for line := 1; scanner.Scan(); line++ {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			var record T
+			err := json.Unmarshal(scanner.Bytes(), &record)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			records = append(records, record)
+		}
+		return records, scanner.Err()
+	case FormatCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = len(c.header)
+		header, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Equal(header, c.header) {
+			return nil, fmt.Errorf("header is %v, expected %v", header, c.header)
+		}
+		for {
+			row, err := cr.Read()
+			if errors.Is(err, io.EOF) {
+				return records, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			record, err := c.fromRow(row)
+			if err != nil {
+				line, _ := cr.FieldPos(0)
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			records = append(records, record)
+		}
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// formatTime and parseTime convert times in CSV files
+func formatTime(t time.Time) string {
+	return t.Format(time.RFC3339Nano)
+}
+
+func parseTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	return t.UTC(), err
+}
+
+// sortedValues returns the records of a collection ordered by ID
+func sortedValues[T any](collection map[int]T, id func(T) int) []T {
+	values := make([]T, 0, len(collection))
+	for _, value := range collection {
+		values = append(values, value)
+	}
+	slices.SortFunc(values, func(a, b T) int { return id(a) - id(b) })
+	return values
+}
@@ -0,0 +1,84 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestImportSkipLeavesOutChirpsOfSkippedUsers(t *testing.T) {
+	dir := t.TempDir()
+	source := NewMemoryDB()
+	taken := mustCreateUser(t, source, "taken@example.com")
+	free := mustCreateUser(t, source, "free@example.com")
+	for _, authorID := range []int{taken.ID, taken.ID, free.ID} {
+		_, err := source.CreateChirp(authorID, "imported")
+		if err != nil {
+			t.Fatalf("CreateChirp: %v", err)
+		}
+	}
+	_, err := source.Export(dir, FormatNDJSON, nil)
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	db := NewMemoryDB()
+	existing := mustCreateUser(t, db, "taken@example.com")
+	report, err := db.Import(dir, ImportOptions{Format: FormatNDJSON, OnConflict: ConflictSkip})
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if report.Users != 1 || report.Skipped != 1 || report.Chirps != 1 || report.SkippedChirps != 2 {
+		t.Errorf("report = %+v, want 1 user and 1 chirp imported, 1 user and 2 chirps skipped", report)
+	}
+
+	chirps, err := db.GetChirpsByAuthor(existing.ID)
+	if err != nil {
+		t.Fatalf("GetChirpsByAuthor: %v", err)
+	}
+	if len(chirps) != 0 {
+		t.Errorf("existing user got the chirps of the skipped user: %+v", chirps)
+	}
+	imported, err := db.GetUserByEmail("free@example.com")
+	if err != nil {
+		t.Fatalf("GetUserByEmail: %v", err)
+	}
+	chirps, err = db.GetChirpsByAuthor(imported.ID)
+	if err != nil {
+		t.Fatalf("GetChirpsByAuthor: %v", err)
+	}
+	if len(chirps) != 1 {
+		t.Errorf("imported user has %d chirps, want 1", len(chirps))
+	}
+}
+
+func TestExportFilesArePrivate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not enforced on windows")
+	}
+	dir := t.TempDir()
+	// an earlier export that anyone could read
+	usersPath := filepath.Join(dir, TransferFileName(collectionUsers, FormatCSV))
+	err := os.WriteFile(usersPath, nil, 0644)
+	if err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	db := NewMemoryDB()
+	mustCreateUser(t, db, "a@example.com")
+	_, err = db.Export(dir, FormatCSV, nil)
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	for _, collection := range []string{collectionUsers, collectionChirps, collectionRevokedTokens} {
+		info, err := os.Stat(filepath.Join(dir, TransferFileName(collection, FormatCSV)))
+		if err != nil {
+			t.Fatalf("stat %s: %v", collection, err)
+		}
+		if mode := info.Mode().Perm(); mode != 0600 {
+			t.Errorf("%s has mode %v, want 0600", collection, mode)
+		}
+	}
+}
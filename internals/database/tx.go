@@ -0,0 +1,459 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+var (
+	ErrNotOwner       = errors.New("not owner")
+	ErrReadOnlyTx     = errors.New("write in read-only transaction")
+	ErrNotDeleted     = errors.New("not deleted")
+	ErrRestoreExpired = errors.New("restore window has passed")
+)
+
+// Tx runs several reads and writes against a DB as one unit.
+// Writes are visible to later reads in the same Tx right away
+// and reach storage together once the Tx function returns nil.
+type Tx struct {
+	data     *DBStructure
+	writable bool
+	changes  []change
+	undo     []change
+	events   []Event
+
+	chirpLastID int
+	userLastID  int
+}
+
+// Update runs fn in a read-write transaction holding the write lock.
+// If fn returns an error, or the changes can't be written to storage,
+// everything fn changed is rolled back and the error is returned.
+// Otherwise the events of the transaction are published to subscribers.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	err := db.lock()
+	if err != nil {
+		return err
+	}
+	defer db.mux.Unlock()
+
+	tx := &Tx{
+		data:        &db.data,
+		writable:    true,
+		chirpLastID: db.data.ChirpLastID,
+		userLastID:  db.data.UserLastID,
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.rollback()
+			panic(p)
+		}
+	}()
+
+	err = fn(tx)
+	if err == nil && len(tx.changes) > 0 {
+		err = db.storage.write(db.data, tx.changes)
+	}
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+	db.feed.publish(tx.events)
+	return nil
+}
+
+// View runs fn in a read-only transaction holding the read lock
+func (db *DB) View(fn func(tx *Tx) error) error {
+	err := db.rlock()
+	if err != nil {
+		return err
+	}
+	defer db.mux.RUnlock()
+
+	return fn(&Tx{data: &db.data})
+}
+
+// apply makes the changes to the data, remembering how to undo them
+func (tx *Tx) apply(changes ...change) error {
+	if !tx.writable {
+		return ErrReadOnlyTx
+	}
+
+	for _, c := range changes {
+		inverse, err := tx.data.apply(c)
+		if err != nil {
+			return err
+		}
+		tx.changes = append(tx.changes, c)
+		tx.undo = append(tx.undo, inverse)
+	}
+	return nil
+}
+
+// publish queues an event to be published once the transaction is written
+func (tx *Tx) publish(event Event) {
+	tx.events = append(tx.events, event)
+}
+
+// rollback undoes all changes of the transaction in reverse order
+func (tx *Tx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.data.apply(tx.undo[i])
+	}
+	tx.data.ChirpLastID, tx.data.UserLastID = tx.chirpLastID, tx.userLastID
+	tx.changes, tx.undo, tx.events = nil, nil, nil
+}
+
+func (tx *Tx) CreateUser(email string, password string) (User, error) {
+	if _, exists := tx.data.userByEmail(email); exists {
+		return User{}, ErrAlreadyExists
+	}
+
+	now := time.Now().UTC()
+	user := User{
+		ID:             tx.data.nextID(collectionUsers),
+		Email:          email,
+		HashedPassword: password,
+		IsChirpyRed:    false,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+
+	err := tx.apply(putUser(user))
+	if err != nil {
+		return User{}, err
+	}
+
+	tx.publish(UserCreated{User: user})
+	return user, nil
+}
+
+func (tx *Tx) GetUserByEmail(email string) (User, error) {
+	user, exists := tx.data.userByEmail(email)
+	if !exists || user.Deleted() {
+		return User{}, errors.New("user not found")
+	}
+
+	return user, nil
+}
+
+func (tx *Tx) GetUser(id int) (User, error) {
+	user, exists := tx.data.Users[id]
+	if !exists || user.Deleted() {
+		return User{}, ErrNotExists
+	}
+
+	return user, nil
+}
+
+func (tx *Tx) UpdateUser(id int, email, hashedPassword, keepSession string) (User, error) {
+	user, exists := tx.data.Users[id]
+	if !exists || user.Deleted() {
+		return User{}, errors.New("user not found")
+	}
+
+	if other, exists := tx.data.userByEmail(email); exists && other.ID != id {
+		return User{}, ErrAlreadyExists
+	}
+
+	// a new password rejects the access tokens issued with the old one
+	// and logs out the other sessions
+	if hashedPassword != user.HashedPassword {
+		user.TokenVersion++
+		_, err := tx.revokeSessionsExcept(id, keepSession)
+		if err != nil {
+			return User{}, err
+		}
+	}
+	user.Email = email
+	user.HashedPassword = hashedPassword
+	user.UpdatedAt = time.Now().UTC()
+
+	err := tx.apply(putUser(user))
+	if err != nil {
+		return User{}, err
+	}
+
+	tx.publish(UserUpdated{User: user})
+	return user, nil
+}
+
+func (tx *Tx) PaintUserRed(userID int) error {
+	user, exists := tx.data.Users[userID]
+	if !exists || user.Deleted() {
+		return ErrNotExists
+	}
+
+	user.IsChirpyRed = true
+	user.UpdatedAt = time.Now().UTC()
+
+	err := tx.apply(putUser(user))
+	if err != nil {
+		return err
+	}
+
+	tx.publish(UserUpdated{User: user})
+	return nil
+}
+
+// DeleteUser leaves a tombstone of the user that no lookup returns,
+// revokes its sessions and deletes its chirps at the same time
+func (tx *Tx) DeleteUser(id int) error {
+	user, exists := tx.data.Users[id]
+	if !exists || user.Deleted() {
+		return ErrNotExists
+	}
+
+	_, err := tx.revokeSessionsExcept(id, "")
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, chirp := range tx.data.chirpsByAuthor(id) {
+		if chirp.Deleted() {
+			continue
+		}
+		chirp.DeletedAt = &now
+		err = tx.apply(putChirp(chirp))
+		if err != nil {
+			return err
+		}
+		tx.publish(ChirpDeleted{Chirp: chirp})
+	}
+
+	user.DeletedAt = &now
+	user.TokenVersion++
+	user.UpdatedAt = now
+	err = tx.apply(putUser(user))
+	if err != nil {
+		return err
+	}
+
+	tx.publish(UserDeleted{User: user})
+	return nil
+}
+
+func (tx *Tx) GetDeletedUserByEmail(email string) (User, error) {
+	user, exists := tx.data.userByEmail(email)
+	if !exists {
+		return User{}, ErrNotExists
+	}
+	if !user.Deleted() {
+		return User{}, ErrNotDeleted
+	}
+
+	return user, nil
+}
+
+// RestoreUser undeletes the user and the chirps deleted together with it
+func (tx *Tx) RestoreUser(id int, deletedAfter time.Time) (User, error) {
+	user, exists := tx.data.Users[id]
+	if !exists {
+		return User{}, ErrNotExists
+	}
+	if !user.Deleted() {
+		return User{}, ErrNotDeleted
+	}
+	if !user.DeletedAt.After(deletedAfter) {
+		return User{}, ErrRestoreExpired
+	}
+
+	for _, chirp := range tx.data.chirpsByAuthor(id) {
+		if !chirp.Deleted() || !chirp.DeletedAt.Equal(*user.DeletedAt) {
+			continue
+		}
+		chirp.DeletedAt = nil
+		err := tx.apply(putChirp(chirp))
+		if err != nil {
+			return User{}, err
+		}
+		tx.publish(ChirpRestored{Chirp: chirp})
+	}
+
+	user.DeletedAt = nil
+	user.UpdatedAt = time.Now().UTC()
+	err := tx.apply(putUser(user))
+	if err != nil {
+		return User{}, err
+	}
+
+	tx.publish(UserRestored{User: user})
+	return user, nil
+}
+
+// PurgeDeletedUsers removes the users deleted before the given time
+// together with everything that belongs to them
+func (tx *Tx) PurgeDeletedUsers(before time.Time) (int, error) {
+	purged := 0
+	for _, user := range tx.data.Users {
+		if !user.Deleted() || !user.DeletedAt.Before(before) {
+			continue
+		}
+
+		changes := []change{}
+		for _, chirp := range tx.data.chirpsByAuthor(user.ID) {
+			changes = append(changes, deleteChirp(chirp.Id))
+		}
+		for _, token := range tx.data.RefreshTokens {
+			if token.UserID == user.ID {
+				changes = append(changes, deleteRefreshToken(token.Hash))
+			}
+		}
+		for _, session := range tx.data.Sessions {
+			if session.UserID == user.ID {
+				changes = append(changes, deleteSession(session.ID))
+			}
+		}
+		changes = append(changes, deleteUser(user.ID))
+
+		err := tx.apply(changes...)
+		if err != nil {
+			return 0, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+func (tx *Tx) CreateChirp(authorID int, body string) (Chirp, error) {
+	now := time.Now().UTC()
+	chirp := Chirp{
+		Id:        tx.data.nextID(collectionChirps),
+		AuthorID:  authorID,
+		Body:      body,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	err := tx.apply(putChirp(chirp))
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	tx.publish(ChirpCreated{Chirp: chirp})
+	return chirp, nil
+}
+
+// DeleteChirp leaves a tombstone of the chirp that no read returns
+func (tx *Tx) DeleteChirp(id int) error {
+	chirp, exists := tx.data.Chirps[id]
+	if !exists || chirp.Deleted() {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	chirp.DeletedAt = &now
+
+	err := tx.apply(putChirp(chirp))
+	if err != nil {
+		return err
+	}
+
+	tx.publish(ChirpDeleted{Chirp: chirp})
+	return nil
+}
+
+func (tx *Tx) RestoreChirpByAuthor(id, authorID int, deletedAfter time.Time) (Chirp, error) {
+	chirp, exists := tx.data.Chirps[id]
+	if !exists {
+		return Chirp{}, ErrNotExists
+	}
+	if chirp.AuthorID != authorID {
+		return Chirp{}, ErrNotOwner
+	}
+	if !chirp.Deleted() {
+		return Chirp{}, ErrNotDeleted
+	}
+	if !chirp.DeletedAt.After(deletedAfter) {
+		return Chirp{}, ErrRestoreExpired
+	}
+
+	chirp.DeletedAt = nil
+
+	err := tx.apply(putChirp(chirp))
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	tx.publish(ChirpRestored{Chirp: chirp})
+	return chirp, nil
+}
+
+func (tx *Tx) PurgeDeletedChirps(before time.Time) (int, error) {
+	purged := 0
+	for _, chirp := range tx.data.Chirps {
+		if !chirp.Deleted() || !chirp.DeletedAt.Before(before) {
+			continue
+		}
+		err := tx.apply(deleteChirp(chirp.Id))
+		if err != nil {
+			return 0, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+func (tx *Tx) GetChirps() ([]Chirp, error) {
+	chirps := make([]Chirp, 0, len(tx.data.Chirps))
+	for _, chirp := range tx.data.Chirps {
+		if chirp.Deleted() {
+			continue
+		}
+		chirps = append(chirps, chirp)
+	}
+
+	return chirps, nil
+}
+
+func (tx *Tx) GetChirpsByAuthor(authorID int) ([]Chirp, error) {
+	chirps := tx.data.chirpsByAuthor(authorID)
+	return slices.DeleteFunc(chirps, Chirp.Deleted), nil
+}
+
+func (tx *Tx) GetChirp(id int) (Chirp, error) {
+	chirp, exists := tx.data.Chirps[id]
+	if !exists || chirp.Deleted() {
+		return Chirp{}, errors.New("chirp does not exist")
+	}
+
+	return chirp, nil
+}
+
+func (tx *Tx) AddRevokedToken(tokenString string, expiresAt time.Time) error {
+	token := RevokedToken{
+		Token:     tokenString,
+		RevokedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt.UTC(),
+	}
+
+	err := tx.apply(putRevokedToken(token))
+	if err != nil {
+		return err
+	}
+
+	tx.publish(TokenRevoked{Token: token})
+	return nil
+}
+
+func (tx *Tx) IsTokenRevoked(tokenString string) (bool, error) {
+	_, exists := tx.data.RevokedTokens[tokenString]
+	return exists, nil
+}
+
+func (tx *Tx) PruneRevokedTokens(before time.Time) (int, error) {
+	pruned := 0
+	for _, token := range tx.data.RevokedTokens {
+		if !token.ExpiresAt.Before(before) {
+			continue
+		}
+		err := tx.apply(deleteRevokedToken(token.Token))
+		if err != nil {
+			return 0, err
+		}
+		pruned++
+	}
+	return pruned, nil
+}
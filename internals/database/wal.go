@@ -0,0 +1,260 @@
+package database
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Number of log records after which the log is folded into a new snapshot
+const defaultSnapshotEvery = 1000
+
+// logStorage keeps a snapshot of the DBStructure in a JSON file
+// and appends every later write to a log next to it.
+// Each write costs only the size of its changes; the log is
+// compacted into the snapshot once it grows past snapshotEvery records.
+type logStorage struct {
+	path          string
+	logPath       string
+	key           []byte
+	log           *os.File
+	records       int
+	snapshotEvery int
+}
+
+// logRecord is one line of the log. All changes of a single write
+// share one record, so a write is either replayed whole or not at all.
+// With encryption the changes are sealed into Sealed instead.
+type logRecord struct {
+	Changes []change `json:"changes,omitempty"`
+	Nonce   []byte   `json:"nonce,omitempty"`
+	Sealed  []byte   `json:"sealed,omitempty"`
+}
+
+// NewLogDB creates a new database backed by a snapshot at path
+// and a write-ahead log at path + ".wal".
+// Existing files are loaded and the log is replayed on top of the snapshot.
+func NewLogDB(path string) (*DB, error) {
+	return NewLogDBWithOptions(path, Options{})
+}
+
+// NewLogDBWithOptions creates a new log backed database like NewLogDB
+// with non-default options. ReloadOnChange is not supported and ignored.
+func NewLogDBWithOptions(path string, opts Options) (*DB, error) {
+	lock, err := acquireLock(path, opts.Lock)
+	if err != nil {
+		return &DB{}, err
+	}
+
+	ls := &logStorage{
+		path:          path,
+		logPath:       path + ".wal",
+		key:           opts.EncryptionKey,
+		snapshotEvery: defaultSnapshotEvery,
+	}
+	db, err := newDB(ls, Options{})
+	if err != nil {
+		ls.close()
+		lock.release()
+		return db, err
+	}
+	db.fileLock = lock
+	db.encryptionKey = opts.EncryptionKey
+	return db, nil
+}
+
+// load reads the snapshot, replays the log and leaves the log open for appending
+func (ls *logStorage) load() (DBStructure, error) {
+	data, err := readDBFile(ls.path, ls.key)
+	if errors.Is(err, os.ErrNotExist) {
+		data, err = newDBStructure(), nil
+	}
+	if err != nil {
+		return data, err
+	}
+
+	// appending always writes at the end, even after a compaction failed halfway
+	ls.log, err = os.OpenFile(ls.logPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return data, err
+	}
+
+	err = ls.replay(&data)
+	if err != nil {
+		ls.log.Close()
+		return data, err
+	}
+
+	if ls.records >= ls.snapshotEvery {
+		return data, ls.compact(data)
+	}
+	return data, nil
+}
+
+// replay applies all complete log records to the data.
+// A torn record at the end of the log, left by a crash during
+// append, is cut off so new records start on a clean line.
+// A complete record that can't be read is a *CorruptError and leaves the log as it is.
+func (ls *logStorage) replay(data *DBStructure) error {
+	reader := bufio.NewReader(ls.log)
+	var offset int64
+	for {
+		// only the last line can lack its newline
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		record := logRecord{}
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			return &CorruptError{Path: ls.logPath, Err: fmt.Errorf("record at offset %d: %w", offset, err)}
+		}
+		if record.Sealed == nil && ls.key != nil {
+			return fmt.Errorf("log %s at offset %d: %w", ls.logPath, offset, ErrNotEncrypted)
+		}
+		if record.Sealed != nil {
+			plaintext, err := unseal(ls.key, record.Nonce, record.Sealed)
+			if err != nil {
+				return fmt.Errorf("log %s at offset %d: %w", ls.logPath, offset, err)
+			}
+			err = json.Unmarshal(plaintext, &record)
+			if err != nil {
+				return fmt.Errorf("log %s at offset %d: %w", ls.logPath, offset, err)
+			}
+		}
+		for _, c := range record.Changes {
+			_, err = data.apply(c)
+			if err != nil {
+				return fmt.Errorf("log %s at offset %d: %w", ls.logPath, offset, err)
+			}
+		}
+		offset += int64(len(line))
+		ls.records++
+	}
+
+	err := ls.log.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	_, err = ls.log.Seek(offset, io.SeekStart)
+	return err
+}
+
+// write appends the changes to the log and syncs it to disk.
+// Once the record is synced the changes are durable, so a failed compaction
+// doesn't fail the write: the log is kept and compacting is tried again on the next write.
+func (ls *logStorage) write(dbStructure DBStructure, changes []change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	line, err := json.Marshal(logRecord{Changes: changes})
+	if err != nil {
+		return err
+	}
+	if ls.key != nil {
+		nonce, sealed, err := seal(ls.key, line)
+		if err != nil {
+			return err
+		}
+		line, err = json.Marshal(logRecord{Nonce: nonce, Sealed: sealed})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = ls.log.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	err = ls.log.Sync()
+	if err != nil {
+		return err
+	}
+
+	ls.records++
+	if ls.records >= ls.snapshotEvery {
+		_ = ls.compact(dbStructure)
+	}
+	return nil
+}
+
+func (ls *logStorage) close() error {
+	if ls.log == nil {
+		return nil
+	}
+	return ls.log.Close()
+}
+
+func (ls *logStorage) rewrite(data DBStructure) error {
+	return ls.compact(data)
+}
+
+// rotateKey folds the log into a snapshot encrypted with newKey,
+// so nothing encrypted with the old key is left.
+// Once the snapshot is written the storage stays on newKey, even if the log can't be emptied.
+func (ls *logStorage) rotateKey(data DBStructure, newKey []byte) error {
+	oldKey := ls.key
+	ls.key = newKey
+	err := ls.writeSnapshot(data)
+	if err != nil {
+		ls.key = oldKey
+		return err
+	}
+
+	err = ls.resetLog()
+	if err != nil {
+		return fmt.Errorf("%w: %s still holds records of the old key, all of them are in the snapshot, remove it: %w",
+			ErrRotationIncomplete, ls.logPath, err)
+	}
+	return nil
+}
+
+// backup copies the snapshot, if there is one yet, and the log
+func (ls *logStorage) backup(suffix string) error {
+	err := copyFile(ls.path, ls.path+suffix)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return copyFile(ls.logPath, ls.logPath+suffix)
+}
+
+// compact writes the data as a new snapshot and empties the log.
+// The snapshot replaces the old one only once it is fully on disk;
+// if we crash before the log is emptied, replaying it again is harmless.
+func (ls *logStorage) compact(data DBStructure) error {
+	err := ls.writeSnapshot(data)
+	if err != nil {
+		return err
+	}
+	return ls.resetLog()
+}
+
+// writeSnapshot atomically replaces the snapshot with the data
+func (ls *logStorage) writeSnapshot(data DBStructure) error {
+	content, err := encodeDBFile(data, ls.key)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ls.path, content, 0)
+}
+
+// resetLog empties the log once its records are in the snapshot
+func (ls *logStorage) resetLog() error {
+	err := ls.log.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = ls.log.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	ls.records = 0
+	return nil
+}
@@ -0,0 +1,133 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLogDBReplaysLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewLogDB(path)
+	if err != nil {
+		t.Fatalf("NewLogDB: %v", err)
+	}
+	user := mustCreateUser(t, db, "a@example.com")
+	chirp, err := db.CreateChirp(user.ID, "hello")
+	if err != nil {
+		t.Fatalf("CreateChirp: %v", err)
+	}
+	db.Close()
+
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("snapshot written before the log was due for compaction: %v", err)
+	}
+
+	db, err = NewLogDB(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+
+	got, err := db.GetChirp(chirp.Id)
+	if err != nil {
+		t.Fatalf("GetChirp after replay: %v", err)
+	}
+	if got.Body != "hello" || got.AuthorID != user.ID {
+		t.Errorf("replayed chirp = %+v, want %+v", got, chirp)
+	}
+	if _, err := db.GetUserByEmail("a@example.com"); err != nil {
+		t.Errorf("GetUserByEmail after replay: %v", err)
+	}
+}
+
+func TestLogDBCutsTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewLogDB(path)
+	if err != nil {
+		t.Fatalf("NewLogDB: %v", err)
+	}
+	mustCreateUser(t, db, "a@example.com")
+	db.Close()
+
+	logPath := path + ".wal"
+	intact, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("read log: %v", err)
+	}
+	// a crash in the middle of an append leaves a line without its newline
+	torn := append(bytes.Clone(intact), []byte(`{"changes":[{"op":"put_user","user":{"id":2,"em`)...)
+	err = os.WriteFile(logPath, torn, 0600)
+	if err != nil {
+		t.Fatalf("write log: %v", err)
+	}
+
+	db, err = NewLogDB(path)
+	if err != nil {
+		t.Fatalf("reopen with torn tail: %v", err)
+	}
+	content, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("read log: %v", err)
+	}
+	if !bytes.Equal(content, intact) {
+		t.Errorf("log after replay = %q, want the torn record cut off: %q", content, intact)
+	}
+
+	// new records start on a clean line
+	mustCreateUser(t, db, "b@example.com")
+	db.Close()
+
+	db, err = NewLogDB(path)
+	if err != nil {
+		t.Fatalf("reopen after append: %v", err)
+	}
+	defer db.Close()
+	for _, email := range []string{"a@example.com", "b@example.com"} {
+		if _, err := db.GetUserByEmail(email); err != nil {
+			t.Errorf("GetUserByEmail(%q): %v", email, err)
+		}
+	}
+}
+
+func TestLogDBReportsCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewLogDB(path)
+	if err != nil {
+		t.Fatalf("NewLogDB: %v", err)
+	}
+	mustCreateUser(t, db, "a@example.com")
+	mustCreateUser(t, db, "b@example.com")
+	db.Close()
+
+	logPath := path + ".wal"
+	content, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("read log: %v", err)
+	}
+	// damage the first of two complete records
+	corrupt := bytes.Replace(content, []byte(`{"changes":[`), []byte(`{"changes":!`), 1)
+	err = os.WriteFile(logPath, corrupt, 0600)
+	if err != nil {
+		t.Fatalf("write log: %v", err)
+	}
+
+	_, err = NewLogDB(path)
+	var corruptErr *CorruptError
+	if !errors.As(err, &corruptErr) {
+		t.Fatalf("NewLogDB with a corrupt record = %v, want a *CorruptError", err)
+	}
+	if corruptErr.Path != logPath {
+		t.Errorf("CorruptError.Path = %q, want %q", corruptErr.Path, logPath)
+	}
+
+	after, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("read log: %v", err)
+	}
+	if !bytes.Equal(after, corrupt) {
+		t.Errorf("log was changed after a corrupt record, %d bytes left of %d", len(after), len(corrupt))
+	}
+}
@@ -0,0 +1,125 @@
+package search
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/speady1445/web_server_course/internals/database"
+)
+
+// How many change events can wait for the ChirpIndex before it has to rebuild
+const eventBuffer = 1024
+
+// ErrStale is returned by ChirpIndex.Search once the index could not be rebuilt
+// and stopped following the DB, its results would miss changes
+var ErrStale = errors.New("search index is out of date")
+
+// ChirpIndex is an Index of the chirps of a database.DB.
+// It is built from the DB and then follows its change events,
+// rebuilding whenever it misses some.
+type ChirpIndex struct {
+	db    *database.DB
+	index atomic.Pointer[Index]
+	// why the index stopped following db, nil while it follows it
+	err     atomic.Pointer[error]
+	onError func(error)
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// IndexChirps builds an index of all chirps of db that are not deleted
+// and keeps it up to date until Close is called or db is closed.
+// onError, if not nil, is called when rebuilding fails; the index then stops following db
+// and Search returns ErrStale.
+func IndexChirps(db *database.DB, onError func(error)) (*ChirpIndex, error) {
+	ci := &ChirpIndex{
+		db:      db,
+		onError: onError,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	sub, err := ci.rebuild()
+	if err != nil {
+		return nil, err
+	}
+	go ci.follow(sub)
+	return ci, nil
+}
+
+// rebuild indexes all chirps from scratch. The returned subscription
+// starts before the chirps are read, so no change is missed.
+func (ci *ChirpIndex) rebuild() (*database.Subscription, error) {
+	sub := ci.db.Subscribe(eventBuffer)
+	chirps, err := ci.db.GetChirps()
+	if err != nil {
+		sub.Close()
+		return nil, err
+	}
+
+	index := NewIndex()
+	for _, chirp := range chirps {
+		index.Add(chirp.Id, chirp.Body)
+	}
+	ci.index.Store(index)
+	return sub, nil
+}
+
+func (ci *ChirpIndex) follow(sub *database.Subscription) {
+	defer close(ci.done)
+
+	for {
+		select {
+		case <-ci.stop:
+			sub.Close()
+			return
+		case event, ok := <-sub.Events():
+			if ok {
+				ci.apply(event)
+				continue
+			}
+		}
+
+		// the subscription ended: the DB was closed or events were missed
+		if sub.Err() == nil {
+			return
+		}
+		var err error
+		sub, err = ci.rebuild()
+		if err != nil {
+			ci.err.Store(&err)
+			if ci.onError != nil {
+				ci.onError(err)
+			}
+			return
+		}
+	}
+}
+
+func (ci *ChirpIndex) apply(event database.Event) {
+	index := ci.index.Load()
+	switch e := event.(type) {
+	case database.ChirpCreated:
+		index.Add(e.Chirp.Id, e.Chirp.Body)
+	case database.ChirpRestored:
+		index.Add(e.Chirp.Id, e.Chirp.Body)
+	case database.ChirpDeleted:
+		index.Remove(e.Chirp.Id)
+	}
+}
+
+// Search finds chirps like Index.Search.
+// It fails with ErrStale once the index stopped following the DB.
+func (ci *ChirpIndex) Search(query string, limit int) ([]Result, error) {
+	if err := ci.err.Load(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrStale, *err)
+	}
+	return ci.index.Load().Search(query, limit), nil
+}
+
+// Close stops following the DB
+func (ci *ChirpIndex) Close() {
+	close(ci.stop)
+	<-ci.done
+}
@@ -0,0 +1,111 @@
+package search
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/speady1445/web_server_course/internals/database"
+)
+
+// waitForResults searches until the index has caught up with the DB and returns want,
+// or fails the test after a second
+func waitForResults(t *testing.T, ci *ChirpIndex, query string, want []int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		results, err := ci.Search(query, 10)
+		if err != nil {
+			t.Fatalf("Search(%q): %v", query, err)
+		}
+		got := resultIDs(results)
+		if slices.Equal(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Search(%q) = %v, want %v", query, got, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestChirpIndexFollowsDB(t *testing.T) {
+	db := database.NewMemoryDB()
+	user, err := db.CreateUser("a@example.com", "hash")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	before, err := db.CreateChirp(user.ID, "indexed when built")
+	if err != nil {
+		t.Fatalf("CreateChirp: %v", err)
+	}
+
+	ci, err := IndexChirps(db, nil)
+	if err != nil {
+		t.Fatalf("IndexChirps: %v", err)
+	}
+	defer ci.Close()
+	waitForResults(t, ci, "indexed", []int{before.Id})
+
+	after, err := db.CreateChirp(user.ID, "indexed from feed")
+	if err != nil {
+		t.Fatalf("CreateChirp: %v", err)
+	}
+	waitForResults(t, ci, "indexed", []int{after.Id, before.Id})
+
+	err = db.DeleteChirp(before.Id)
+	if err != nil {
+		t.Fatalf("DeleteChirp: %v", err)
+	}
+	waitForResults(t, ci, "indexed", []int{after.Id})
+
+	_, err = db.RestoreChirpByAuthor(before.Id, user.ID, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("RestoreChirpByAuthor: %v", err)
+	}
+	waitForResults(t, ci, "indexed", []int{after.Id, before.Id})
+
+	// deleting and restoring the author takes all of their chirps along
+	err = db.DeleteUser(user.ID)
+	if err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	waitForResults(t, ci, "indexed", []int{})
+	_, err = db.RestoreUser(user.ID, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("RestoreUser: %v", err)
+	}
+	waitForResults(t, ci, "indexed", []int{after.Id, before.Id})
+}
+
+func TestChirpIndexRebuildsAfterRestore(t *testing.T) {
+	source := database.NewMemoryDB()
+	user, err := source.CreateUser("a@example.com", "hash")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	chirp, err := source.CreateChirp(user.ID, "from the snapshot")
+	if err != nil {
+		t.Fatalf("CreateChirp: %v", err)
+	}
+	snapshot := &bytes.Buffer{}
+	err = source.Snapshot(snapshot)
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	db := database.NewMemoryDB()
+	ci, err := IndexChirps(db, func(err error) { t.Errorf("rebuild: %v", err) })
+	if err != nil {
+		t.Fatalf("IndexChirps: %v", err)
+	}
+	defer ci.Close()
+
+	// a restore ends the subscription, the index rebuilds from the new data
+	err = db.Restore(snapshot)
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	waitForResults(t, ci, "snapshot", []int{chirp.Id})
+}
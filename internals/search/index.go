@@ -0,0 +1,215 @@
+package search
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// BM25 parameters: how fast repeating a term stops adding to the score
+// and how much long documents are penalized
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// Index is an inverted index of short documents, like chirps, by ID.
+// It is safe for concurrent use.
+type Index struct {
+	mux sync.RWMutex
+	// term -> document ID -> positions of the term in the document
+	postings map[string]map[int][]int
+	// document ID -> its distinct terms, to remove it again
+	terms map[int][]string
+	// document ID -> number of tokens
+	lengths     map[int]int
+	totalLength int
+}
+
+// Result is a document matching a query
+type Result struct {
+	ID    int
+	Score float64
+}
+
+func NewIndex() *Index {
+	return &Index{
+		postings: map[string]map[int][]int{},
+		terms:    map[int][]string{},
+		lengths:  map[int]int{},
+	}
+}
+
+// Tokenize splits text into lowercase words of letters and digits
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Add indexes a document, replacing an earlier one with the same ID
+func (idx *Index) Add(id int, text string) {
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+
+	idx.remove(id)
+
+	tokens := Tokenize(text)
+	positions := map[string][]int{}
+	for i, token := range tokens {
+		positions[token] = append(positions[token], i)
+	}
+
+	terms := make([]string, 0, len(positions))
+	for term, pos := range positions {
+		docs, exists := idx.postings[term]
+		if !exists {
+			docs = map[int][]int{}
+			idx.postings[term] = docs
+		}
+		docs[id] = pos
+		terms = append(terms, term)
+	}
+	idx.terms[id] = terms
+	idx.lengths[id] = len(tokens)
+	idx.totalLength += len(tokens)
+}
+
+// Remove drops a document from the index, if it is there
+func (idx *Index) Remove(id int) {
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+
+	idx.remove(id)
+}
+
+func (idx *Index) remove(id int) {
+	terms, exists := idx.terms[id]
+	if !exists {
+		return
+	}
+
+	for _, term := range terms {
+		docs := idx.postings[term]
+		delete(docs, id)
+		if len(docs) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	idx.totalLength -= idx.lengths[id]
+	delete(idx.terms, id)
+	delete(idx.lengths, id)
+}
+
+// Len returns the number of documents in the index
+func (idx *Index) Len() int {
+	idx.mux.RLock()
+	defer idx.mux.RUnlock()
+
+	return len(idx.lengths)
+}
+
+// Search returns up to limit documents that contain every word and phrase of the query,
+// best match first. Phrases are words in double quotes that must appear in that order.
+// Matches are ranked with BM25, documents scoring the same newest (highest ID) first.
+func (idx *Index) Search(query string, limit int) []Result {
+	q := ParseQuery(query)
+	if q.empty() {
+		return []Result{}
+	}
+
+	idx.mux.RLock()
+	defer idx.mux.RUnlock()
+
+	terms := q.terms()
+	candidates := idx.candidates(terms)
+
+	results := []Result{}
+	for _, id := range candidates {
+		if !idx.containsPhrases(id, q.Phrases) {
+			continue
+		}
+		results = append(results, Result{ID: id, Score: idx.score(id, terms)})
+	}
+
+	slices.SortFunc(results, func(a, b Result) int {
+		if order := cmp.Compare(b.Score, a.Score); order != 0 {
+			return order
+		}
+		return b.ID - a.ID
+	})
+	return results[:min(len(results), limit)]
+}
+
+// candidates returns the documents containing all terms
+func (idx *Index) candidates(terms []string) []int {
+	postings := make([]map[int][]int, 0, len(terms))
+	for _, term := range terms {
+		docs, exists := idx.postings[term]
+		if !exists {
+			return nil
+		}
+		postings = append(postings, docs)
+	}
+	slices.SortFunc(postings, func(a, b map[int][]int) int { return len(a) - len(b) })
+
+	ids := []int{}
+	for id := range postings[0] {
+		inAll := true
+		for _, docs := range postings[1:] {
+			if _, exists := docs[id]; !exists {
+				inAll = false
+				break
+			}
+		}
+		if inAll {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// containsPhrases reports whether every phrase appears in the document word by word
+func (idx *Index) containsPhrases(id int, phrases [][]string) bool {
+	for _, phrase := range phrases {
+		if !idx.containsPhrase(id, phrase) {
+			return false
+		}
+	}
+	return true
+}
+
+func (idx *Index) containsPhrase(id int, phrase []string) bool {
+	for _, start := range idx.postings[phrase[0]][id] {
+		found := true
+		for offset, term := range phrase[1:] {
+			if !slices.Contains(idx.postings[term][id], start+offset+1) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// score rates how well a document matches the terms with BM25
+func (idx *Index) score(id int, terms []string) float64 {
+	documents := float64(len(idx.lengths))
+	averageLength := float64(idx.totalLength) / documents
+	length := float64(idx.lengths[id])
+
+	score := 0.0
+	for _, term := range terms {
+		docs := idx.postings[term]
+		frequency := float64(len(docs[id]))
+		idf := math.Log(1 + (documents-float64(len(docs))+0.5)/(float64(len(docs))+0.5))
+		score += idf * frequency * (bm25K1 + 1) / (frequency + bm25K1*(1-bm25B+bm25B*length/averageLength))
+	}
+	return score
+}
@@ -0,0 +1,113 @@
+package search
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Hello, World!", []string{"hello", "world"}},
+		{"ÉCOLE straße", []string{"école", "straße"}},
+		{"go1.22 is out", []string{"go1", "22", "is", "out"}},
+		{"don't", []string{"don", "t"}},
+		{"  ... ", []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			got := Tokenize(tt.text)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Tokenize(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+// resultIDs returns the document IDs of the results in order
+func resultIDs(results []Result) []int {
+	ids := make([]int, 0, len(results))
+	for _, result := range results {
+		ids = append(ids, result.ID)
+	}
+	return ids
+}
+
+func TestIndexSearch(t *testing.T) {
+	idx := NewIndex()
+	idx.Add(1, "The quick brown fox")
+	idx.Add(2, "A brown dog and a QUICK cat")
+	idx.Add(3, "quick quick quick")
+	idx.Add(4, "Nothing to see here")
+
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		// matching is case-insensitive
+		{"QUICK", []int{3, 1, 2}},
+		{"brown quick", []int{1, 2}},
+		{`"quick brown"`, []int{1}},
+		{`"brown quick"`, []int{}},
+		{`"quick quick" quick`, []int{3}},
+		{"missing", []int{}},
+		{"quick missing", []int{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got := resultIDs(idx.Search(tt.query, 10))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Search(%q) = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIndexSearchRanking(t *testing.T) {
+	idx := NewIndex()
+	// the rarer term outweighs the common one
+	idx.Add(1, "common common common")
+	idx.Add(2, "common rare")
+	idx.Add(3, "common")
+	idx.Add(4, "common")
+	// a short document beats a long one with the term as often
+	idx.Add(5, "rare and then a lot of other words to make it long")
+	// ties go to the newest document
+	idx.Add(6, "common")
+
+	if got, want := resultIDs(idx.Search("rare", 10)), []int{2, 5}; !slices.Equal(got, want) {
+		t.Errorf("Search(rare) = %v, want %v", got, want)
+	}
+	if got, want := resultIDs(idx.Search("common", 10)), []int{1, 6, 4, 3, 2}; !slices.Equal(got, want) {
+		t.Errorf("Search(common) = %v, want %v", got, want)
+	}
+	if got, want := resultIDs(idx.Search("common", 2)), []int{1, 6}; !slices.Equal(got, want) {
+		t.Errorf("Search(common) with limit 2 = %v, want %v", got, want)
+	}
+}
+
+func TestIndexAddReplacesAndRemoves(t *testing.T) {
+	idx := NewIndex()
+	idx.Add(1, "old words")
+	idx.Add(1, "new words")
+
+	if got := idx.Search("old", 10); len(got) != 0 {
+		t.Errorf("Search(old) after replacing = %v, want nothing", got)
+	}
+	if got := resultIDs(idx.Search("new", 10)); !slices.Equal(got, []int{1}) {
+		t.Errorf("Search(new) = %v, want [1]", got)
+	}
+
+	idx.Remove(1)
+	idx.Remove(2)
+	if idx.Len() != 0 {
+		t.Errorf("Len() after Remove = %d, want 0", idx.Len())
+	}
+	if got := idx.Search("words", 10); len(got) != 0 {
+		t.Errorf("Search(words) after Remove = %v, want nothing", got)
+	}
+}
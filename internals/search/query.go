@@ -0,0 +1,44 @@
+package search
+
+import (
+	"slices"
+	"strings"
+)
+
+// Query is a parsed search query
+type Query struct {
+	// Words must each appear somewhere in a match
+	Words []string
+	// Phrases must appear word by word in a match
+	Phrases [][]string
+}
+
+// ParseQuery splits a query into words and "quoted phrases".
+// A quote that is not closed runs to the end of the query.
+func ParseQuery(query string) Query {
+	q := Query{}
+	for i, part := range strings.Split(query, `"`) {
+		tokens := Tokenize(part)
+		// odd parts are between quotes
+		if i%2 == 1 && len(tokens) > 1 {
+			q.Phrases = append(q.Phrases, tokens)
+			continue
+		}
+		q.Words = append(q.Words, tokens...)
+	}
+	return q
+}
+
+func (q Query) empty() bool {
+	return len(q.Words) == 0 && len(q.Phrases) == 0
+}
+
+// terms returns every distinct word of the query, including those in phrases
+func (q Query) terms() []string {
+	terms := slices.Clone(q.Words)
+	for _, phrase := range q.Phrases {
+		terms = append(terms, phrase...)
+	}
+	slices.Sort(terms)
+	return slices.Compact(terms)
+}
@@ -0,0 +1,31 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  Query
+	}{
+		{"Hello World", Query{Words: []string{"hello", "world"}}},
+		{`"hello world" again`, Query{Words: []string{"again"}, Phrases: [][]string{{"hello", "world"}}}},
+		{`first "one two" "three four"`, Query{Words: []string{"first"}, Phrases: [][]string{{"one", "two"}, {"three", "four"}}}},
+		// a quoted single word is just a word
+		{`"alone" word`, Query{Words: []string{"alone", "word"}}},
+		// an unclosed quote runs to the end
+		{`a "b c`, Query{Words: []string{"a"}, Phrases: [][]string{{"b", "c"}}}},
+		{`"" !!`, Query{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got := ParseQuery(tt.query)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseQuery(%q) = %+v, want %+v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
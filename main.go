@@ -1,168 +1,423 @@
-package main
-
-import (
-	"encoding/json"
-	"flag"
-	"fmt"
-	"net/http"
-	"os"
-
-	"github.com/joho/godotenv"
-	"github.com/speady1445/web_server_course/internals/database"
-)
-
-const (
-	dbPath = "database.json"
-)
-
-type apiConfig struct {
-	db             *database.DB
-	fileserverHits int
-	jwtSecret      string
-	polkaApiKey    string
-}
-
-func main() {
-	const port = "8080"
-
-	godotenv.Load()
-
-	jwtSecret, found := os.LookupEnv("JWT_SECRET")
-	if !found {
-		fmt.Println("JWT_SECRET not found")
-		os.Exit(1)
-	}
-
-	polkaApiKey, found := os.LookupEnv("POLKA_API_KEY")
-	if !found {
-		fmt.Println("POLKA_API_KEY not found")
-		os.Exit(1)
-	}
-
-	err := debug()
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-
-	db, err := database.NewDB(dbPath)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-
-	apiCfg := apiConfig{
-		db:             db,
-		fileserverHits: 0,
-		jwtSecret:      jwtSecret,
-		polkaApiKey:    polkaApiKey,
-	}
-
-	mux := http.NewServeMux()
-	mux.Handle("/app/*", apiCfg.middlewareMetricsInc(http.StripPrefix("/app/", http.FileServer(http.Dir(".")))))
-	mux.HandleFunc("GET /admin/metrics", apiCfg.handlerMetrics)
-	mux.HandleFunc("GET /api/reset", apiCfg.handlerReset)
-	mux.HandleFunc("GET /api/healthz", healthz)
-
-	mux.HandleFunc("POST /api/users", apiCfg.handlerAddUser)
-	mux.HandleFunc("PUT /api/users", apiCfg.handlerUpdateUser)
-	mux.HandleFunc("POST /api/login", apiCfg.handlerLogin)
-	mux.HandleFunc("POST /api/refresh", apiCfg.handlerRefreshToken)
-	mux.HandleFunc("POST /api/revoke", apiCfg.handlerRevokeToken)
-
-	mux.HandleFunc("POST /api/chirps", apiCfg.handlerAddChirp)
-	mux.HandleFunc("GET /api/chirps", apiCfg.handlerGetChirps)
-	mux.HandleFunc("GET /api/chirps/{chirpid}", apiCfg.handlerGetChirp)
-	mux.HandleFunc("DELETE /api/chirps/{chirpid}", apiCfg.handlerDeleteChirp)
-
-	mux.HandleFunc("POST /api/polka/webhooks", apiCfg.handlerPaintUserRed)
-
-	corsMux := middlewareCors(mux)
-
-	server := http.Server{
-		Addr:    ":" + port,
-		Handler: corsMux,
-	}
-
-	fmt.Println("Listening on port " + port)
-	server.ListenAndServe()
-}
-
-func debug() error {
-	dbg := flag.Bool("debug", false, "Enable debug mode")
-	flag.Parse()
-
-	if *dbg {
-		err := os.Remove(dbPath)
-		return err
-	}
-
-	return nil
-}
-
-func middlewareCors(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "*")
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
-}
-
-func healthz(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
-}
-
-func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cfg.fileserverHits++
-		next.ServeHTTP(w, r)
-	})
-}
-
-func (cfg *apiConfig) handlerReset(w http.ResponseWriter, _ *http.Request) {
-	cfg.fileserverHits = 0
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Hits reset to 0."))
-}
-
-func (cfg *apiConfig) handlerMetrics(w http.ResponseWriter, _ *http.Request) {
-	w.Header().Add("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf(`
-<html>
-
-<body>
-	<h1>Welcome, Chirpy Admin</h1>
-	<p>Chirpy has been visited %d times!</p>
-</body>
-
-</html>
-	`, cfg.fileserverHits)))
-}
-
-func respondWithError(w http.ResponseWriter, status int, errMsg string) {
-	type errorResponse struct {
-		Error string `json:"error"`
-	}
-
-	respondWith(w, status, errorResponse{Error: errMsg})
-}
-
-func respondWith(w http.ResponseWriter, status int, content interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	returnErr, err := json.Marshal(content)
-	if err != nil {
-		fmt.Println("Error marshalling JSON:", err)
-		w.WriteHeader(500)
-	}
-	w.WriteHeader(status)
-	w.Write(returnErr)
-}
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/speady1445/web_server_course/internals/auth"
+	"github.com/speady1445/web_server_course/internals/database"
+	"github.com/speady1445/web_server_course/internals/search"
+)
+
+const (
+	dbPath      = "database.json"
+	sqlitePath  = "database.sqlite"
+	keyringPath = "jwt_keys.json"
+)
+
+type apiConfig struct {
+	db             database.Store
+	fileserverHits int
+	jwtKeys        *auth.Keyring
+	polkaApiKey    string
+	adminApiKey    string
+	restoreWindow  time.Duration
+	searchIndex    *search.ChirpIndex
+}
+
+func main() {
+	const port = "8080"
+
+	godotenv.Load()
+
+	// only needed until the keyring file exists, see -rotate-jwt-key
+	jwtSecret := os.Getenv("JWT_SECRET")
+
+	polkaApiKey, found := os.LookupEnv("POLKA_API_KEY")
+	if !found {
+		fmt.Println("POLKA_API_KEY not found")
+		os.Exit(1)
+	}
+
+	adminApiKey := os.Getenv("ADMIN_API_KEY")
+
+	var encryptionKey []byte
+	if encoded, found := os.LookupEnv("DB_ENCRYPTION_KEY"); found {
+		key, err := database.ParseEncryptionKey(encoded)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		encryptionKey = key
+	}
+
+	dbg := flag.Bool("debug", false, "Enable debug mode")
+	backend := flag.String("backend", "json", "Database backend: json, wal, sqlite or memory")
+	reload := flag.Bool("reload", false, "Reload the json database when it is edited by another program")
+	lockMode := flag.String("lock", "fail", "When another process uses the database: fail, wait or none to not lock")
+	pruneInterval := flag.Duration("prune-interval", database.DefaultPruneInterval, "How often expired revoked tokens and deleted chirps are removed from the database")
+	rotateJWTKey := flag.Bool("rotate-jwt-key", false, "Add a new token signing key to "+keyringPath+", drop old ones past -jwt-key-retention and exit")
+	jwtKeyRetention := flag.Duration("jwt-key-retention", 60*24*time.Hour, "How long replaced token signing keys still verify tokens, at least the refresh token lifetime")
+	jwtAlgorithm := flag.String("jwt-alg", auth.AlgorithmHS256, "Algorithm of the key made by -rotate-jwt-key: HS256, EdDSA or RS256")
+	jwtPrivateKey := flag.String("jwt-private-key", "", "PEM file with an Ed25519 or RSA private key for -rotate-jwt-key to sign with instead of making a key")
+	restoreWindow := flag.Duration("restore-window", 24*time.Hour, "How long deleted chirps and users can be restored")
+	chirpRetention := flag.Duration("chirp-retention", 30*24*time.Hour, "How long deleted chirps and users are kept before they are purged")
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "Print the database migrations that would run and exit")
+	rotateKey := flag.Bool("rotate-key", false, "Re-encrypt the database with the key in DB_ENCRYPTION_KEY_NEW and exit")
+	snapshot := flag.Bool("snapshot", false, "Save a compressed snapshot of the database to the current directory and exit")
+	restore := flag.String("restore", "", "Replace the database with the given snapshot file and exit")
+	exportDir := flag.String("export", "", "Export users, chirps and revoked tokens to files in the given directory and exit")
+	importDir := flag.String("import", "", "Import users, chirps and revoked tokens from files in the given directory and exit")
+	transferFormat := flag.String("format", "ndjson", "Format of exported and imported files: ndjson or csv")
+	onConflict := flag.String("on-conflict", "fail", "What import does with users whose email is taken: fail, skip or overwrite")
+	flag.Parse()
+
+	if *migrateDryRun {
+		err := planMigrations(encryptionKey)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *rotateJWTKey {
+		err := rotateSigningKey(jwtSecret, auth.Rotation{
+			Algorithm:      *jwtAlgorithm,
+			PrivateKeyFile: *jwtPrivateKey,
+			Retention:      *jwtKeyRetention,
+		})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *dbg {
+		err := debug()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if *pruneInterval <= 0 {
+		fmt.Println("-prune-interval must be positive")
+		os.Exit(1)
+	}
+
+	if *chirpRetention < *restoreWindow {
+		fmt.Println("-chirp-retention must not be shorter than -restore-window")
+		os.Exit(1)
+	}
+
+	lock, err := parseLockMode(*lockMode)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	opts := database.Options{
+		ReloadOnChange: *reload,
+		Lock:           lock,
+		EncryptionKey:  encryptionKey,
+	}
+
+	if *rotateKey {
+		err := rotateEncryptionKey(*backend, opts)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *snapshot {
+		err := saveSnapshot(*backend, opts)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *restore != "" {
+		err := restoreSnapshot(*backend, opts, *restore)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *exportDir != "" || *importDir != "" {
+		format, err := database.ParseFormat(*transferFormat)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if *exportDir != "" {
+			err = exportData(*backend, opts, *exportDir, format)
+		} else {
+			err = importData(*backend, opts, *importDir, format, *onConflict)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	jwtKeys, err := auth.LoadKeyring(keyringPath, jwtSecret)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	db, err := openStore(*backend, opts)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// only the json and wal backends publish the changes the search index follows
+	var searchIndex *search.ChirpIndex
+	if jsonDB, ok := db.(*database.DB); ok {
+		searchIndex, err = search.IndexChirps(jsonDB, func(err error) {
+			fmt.Println("Rebuilding search index failed, search is unavailable until restart:", err)
+		})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	apiCfg := apiConfig{
+		db:             db,
+		fileserverHits: 0,
+		jwtKeys:        jwtKeys,
+		polkaApiKey:    polkaApiKey,
+		adminApiKey:    adminApiKey,
+		restoreWindow:  *restoreWindow,
+		searchIndex:    searchIndex,
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/app/*", apiCfg.middlewareMetricsInc(http.StripPrefix("/app/", http.FileServer(http.Dir(".")))))
+	mux.HandleFunc("GET /admin/metrics", apiCfg.handlerMetrics)
+	mux.HandleFunc("GET /admin/snapshot", apiCfg.handlerSnapshot)
+	mux.HandleFunc("POST /admin/restore", apiCfg.handlerRestore)
+	mux.HandleFunc("GET /api/reset", apiCfg.handlerReset)
+	mux.HandleFunc("GET /api/healthz", healthz)
+	mux.HandleFunc("GET /.well-known/jwks.json", apiCfg.handlerJWKS)
+
+	mux.HandleFunc("POST /api/users", apiCfg.handlerAddUser)
+	mux.HandleFunc("PUT /api/users", apiCfg.handlerUpdateUser)
+	mux.HandleFunc("DELETE /api/users", apiCfg.handlerDeleteUser)
+	mux.HandleFunc("POST /api/users/restore", apiCfg.handlerRestoreUser)
+	mux.HandleFunc("POST /api/login", apiCfg.handlerLogin)
+	mux.HandleFunc("POST /api/refresh", apiCfg.handlerRefreshToken)
+	mux.HandleFunc("POST /api/revoke", apiCfg.handlerRevokeToken)
+	mux.HandleFunc("GET /api/sessions", apiCfg.handlerGetSessions)
+	mux.HandleFunc("DELETE /api/sessions", apiCfg.handlerRevokeAllSessions)
+	mux.HandleFunc("DELETE /api/sessions/{sessionid}", apiCfg.handlerRevokeSession)
+
+	mux.HandleFunc("POST /api/chirps", apiCfg.handlerAddChirp)
+	mux.HandleFunc("GET /api/chirps", apiCfg.handlerGetChirps)
+	mux.HandleFunc("GET /api/chirps/search", apiCfg.handlerSearchChirps)
+	mux.HandleFunc("GET /api/chirps/{chirpid}", apiCfg.handlerGetChirp)
+	mux.HandleFunc("DELETE /api/chirps/{chirpid}", apiCfg.handlerDeleteChirp)
+	mux.HandleFunc("POST /api/chirps/{chirpid}/restore", apiCfg.handlerRestoreChirp)
+
+	mux.HandleFunc("POST /api/polka/webhooks", apiCfg.handlerPaintUserRed)
+
+	corsMux := middlewareCors(mux)
+
+	server := http.Server{
+		Addr:    ":" + port,
+		Handler: corsMux,
+	}
+
+	janitor := database.StartJanitor(db, *pruneInterval, *chirpRetention, func(err error) {
+		fmt.Println("Cleaning up database:", err)
+	})
+
+	go func() {
+		fmt.Println("Listening on port " + port)
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	fmt.Println("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != nil {
+		fmt.Println(err)
+	}
+	janitor.Stop()
+	if searchIndex != nil {
+		searchIndex.Close()
+	}
+	err = db.Close()
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func debug() error {
+	paths := []string{
+		dbPath, dbPath + ".wal", dbPath + ".1", dbPath + ".2",
+		sqlitePath, sqlitePath + "-wal", sqlitePath + "-shm",
+	}
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseLockMode(mode string) (database.LockMode, error) {
+	switch mode {
+	case "fail":
+		return database.LockFail, nil
+	case "wait":
+		return database.LockWait, nil
+	case "none":
+		return database.LockNone, nil
+	}
+	return database.LockNone, fmt.Errorf("unknown lock mode %q", mode)
+}
+
+func openStore(backend string, opts database.Options) (database.Store, error) {
+	switch backend {
+	case "json":
+		db, err := database.NewDBWithOptions(dbPath, opts)
+		if err != nil {
+			return nil, err
+		}
+		if recovered := db.Recovered(); recovered != nil {
+			fmt.Println("Restored database from backup:", recovered)
+		}
+		printMigrated(db)
+		return db, nil
+	case "wal":
+		db, err := database.NewLogDBWithOptions(dbPath, opts)
+		if err != nil {
+			return nil, err
+		}
+		printMigrated(db)
+		return db, nil
+	case "sqlite":
+		db, err := database.NewSQLDB(sqlitePath)
+		if err != nil {
+			return nil, err
+		}
+		printMigrated(db)
+		return db, nil
+	case "memory":
+		return database.NewMemoryDB(), nil
+	}
+	return nil, fmt.Errorf("unknown database backend %q", backend)
+}
+
+// printMigrated tells what the migrations run on opening the DB changed
+func printMigrated(db interface{ Migrated() []string }) {
+	for _, migration := range db.Migrated() {
+		fmt.Println("Migrated database to", migration)
+	}
+}
+
+func middlewareCors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "*")
+		w.Header().Set("Access-Control-Expose-Headers", "Link, X-Next-Cursor, X-Prev-Cursor")
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// handlerJWKS publishes the public keys access tokens can be verified with
+func (cfg *apiConfig) handlerJWKS(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWith(w, http.StatusOK, cfg.jwtKeys.JWKS())
+}
+
+func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg.fileserverHits++
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (cfg *apiConfig) handlerReset(w http.ResponseWriter, _ *http.Request) {
+	cfg.fileserverHits = 0
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Hits reset to 0."))
+}
+
+func (cfg *apiConfig) handlerMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf(`
+<html>
+
+<body>
+	<h1>Welcome, Chirpy Admin</h1>
+	<p>Chirpy has been visited %d times!</p>
+</body>
+
+</html>
+	`, cfg.fileserverHits)))
+}
+
+func respondWithError(w http.ResponseWriter, status int, errMsg string) {
+	type errorResponse struct {
+		Error string `json:"error"`
+	}
+
+	respondWith(w, status, errorResponse{Error: errMsg})
+}
+
+func respondWith(w http.ResponseWriter, status int, content interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	returnErr, err := json.Marshal(content)
+	if err != nil {
+		fmt.Println("Error marshalling JSON:", err)
+		w.WriteHeader(500)
+	}
+	w.WriteHeader(status)
+	w.Write(returnErr)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type invalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// queryParser reads query parameters, collecting every one that is invalid
+// so they can all be reported at once
+type queryParser struct {
+	values  url.Values
+	invalid []invalidParam
+}
+
+func newQueryParser(r *http.Request) *queryParser {
+	return &queryParser{values: r.URL.Query()}
+}
+
+func (p *queryParser) fail(name, reason string) {
+	p.invalid = append(p.invalid, invalidParam{Name: name, Reason: reason})
+}
+
+// ok reports whether all parameters read so far are valid
+func (p *queryParser) ok() bool {
+	return len(p.invalid) == 0
+}
+
+// respondWithInvalid sends the collected problems as a 400 response
+func (p *queryParser) respondWithInvalid(w http.ResponseWriter) {
+	type errorResponse struct {
+		Error         string         `json:"error"`
+		InvalidParams []invalidParam `json:"invalid_params"`
+	}
+
+	names := make([]string, 0, len(p.invalid))
+	for _, param := range p.invalid {
+		names = append(names, param.Name)
+	}
+	respondWith(w, http.StatusBadRequest, errorResponse{
+		Error:         "Invalid query parameters: " + strings.Join(names, ", "),
+		InvalidParams: p.invalid,
+	})
+}
+
+// ids reads a list of IDs, given as repeated parameters or comma separated
+func (p *queryParser) ids(name string) []int {
+	ids := []int{}
+	for _, value := range p.values[name] {
+		for _, s := range strings.Split(value, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				p.fail(name, "must be a comma separated list of IDs")
+				return nil
+			}
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// time reads an RFC 3339 time, zero if the parameter is missing
+func (p *queryParser) time(name string) time.Time {
+	value := p.values.Get(name)
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		p.fail(name, "must be an RFC 3339 time like 2006-01-02T15:04:05Z")
+		return time.Time{}
+	}
+	return t
+}
+
+// intRange reads a number between min and max, def if the parameter is missing
+func (p *queryParser) intRange(name string, def, min, max int) int {
+	value := p.values.Get(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		p.fail(name, "must be a number between "+strconv.Itoa(min)+" and "+strconv.Itoa(max))
+		return def
+	}
+	return n
+}
+
+// oneOf reads one of the allowed values, def if the parameter is missing
+func (p *queryParser) oneOf(name, def string, allowed ...string) string {
+	value := p.values.Get(name)
+	if value == "" {
+		return def
+	}
+	if !slices.Contains(allowed, value) {
+		p.fail(name, "must be one of "+strings.Join(allowed, ", "))
+		return def
+	}
+	return value
+}
+
+func (p *queryParser) string(name string) string {
+	return p.values.Get(name)
+}
+
+// unsupported rejects a parameter that can't be served
+func (p *queryParser) unsupported(name, reason string) {
+	if p.values.Has(name) {
+		p.fail(name, reason)
+	}
+}
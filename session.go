@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/speady1445/web_server_course/internals/auth"
+	"github.com/speady1445/web_server_course/internals/database"
+)
+
+type responseSession struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	// Current is the session the request was made with
+	Current bool `json:"current"`
+}
+
+// authenticate returns the claims of the access token of the request.
+// Tokens that were denied, or issued before the user last changed the password
+// or logged out everywhere, are rejected.
+func (c *apiConfig) authenticate(r *http.Request) (auth.AccessClaims, error) {
+	claims, err := auth.ParseAccessToken(c.jwtKeys, r.Header)
+	if err != nil {
+		return auth.AccessClaims{}, err
+	}
+
+	user, err := c.db.GetUser(claims.UserID)
+	if err != nil {
+		return auth.AccessClaims{}, errors.New("unknown user")
+	}
+	if claims.TokenVersion != user.TokenVersion {
+		return auth.AccessClaims{}, errors.New("token revoked")
+	}
+
+	if claims.ID != "" {
+		denied, err := c.db.IsTokenRevoked(claims.ID)
+		if err != nil {
+			return auth.AccessClaims{}, err
+		}
+		if denied {
+			return auth.AccessClaims{}, errors.New("token revoked")
+		}
+	}
+	return claims, nil
+}
+
+// clientOf describes who made the request, for the session it starts
+func clientOf(r *http.Request) database.Client {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return database.Client{UserAgent: r.UserAgent(), IP: ip}
+}
+
+func (c *apiConfig) handlerGetSessions(w http.ResponseWriter, r *http.Request) {
+	claims, err := c.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid access token.")
+		return
+	}
+
+	sessions, err := c.db.GetSessions(claims.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error getting sessions.")
+		return
+	}
+
+	response := make([]responseSession, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, responseSession{
+			ID:         session.ID,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			ExpiresAt:  session.ExpiresAt,
+			UserAgent:  session.UserAgent,
+			IP:         session.IP,
+			Current:    session.ID == claims.SessionID,
+		})
+	}
+	respondWith(w, http.StatusOK, response)
+}
+
+// handlerRevokeSession logs the user out of one session
+func (c *apiConfig) handlerRevokeSession(w http.ResponseWriter, r *http.Request) {
+	claims, err := c.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid access token.")
+		return
+	}
+
+	err = c.db.RevokeSession(r.PathValue("sessionid"), claims.UserID)
+	if errors.Is(err, database.ErrNotExists) {
+		respondWithError(w, http.StatusNotFound, "Session not found.")
+		return
+	}
+	if errors.Is(err, database.ErrNotOwner) {
+		respondWithError(w, http.StatusForbidden, "You can only revoke your own sessions.")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error revoking session.")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlerRevokeAllSessions logs the user out everywhere,
+// including the access tokens already handed out
+func (c *apiConfig) handlerRevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	claims, err := c.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid access token.")
+		return
+	}
+
+	_, err = c.db.RevokeAllSessions(claims.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error revoking sessions.")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -1,243 +1,431 @@
-package main
-
-import (
-	"encoding/json"
-	"errors"
-	"net/http"
-
-	"github.com/speady1445/web_server_course/internals/auth"
-	"github.com/speady1445/web_server_course/internals/database"
-)
-
-type responseUser struct {
-	ID          int    `json:"id"`
-	Email       string `json:"email"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
-}
-
-func dbUserToResponseUser(dbUser database.User) responseUser {
-	return responseUser{
-		ID:          dbUser.ID,
-		Email:       dbUser.Email,
-		IsChirpyRed: dbUser.IsChirpyRed,
-	}
-}
-
-func (c *apiConfig) handlerAddUser(w http.ResponseWriter, r *http.Request) {
-	type parameters struct {
-		Password string `json:"password"`
-		Email    string `json:"email"`
-	}
-
-	decoder := json.NewDecoder(r.Body)
-	params := parameters{}
-
-	err := decoder.Decode(&params)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid input")
-		return
-	}
-
-	hash, err := auth.HashPassword(params.Password)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	dbUser, err := c.db.CreateUser(params.Email, hash)
-	if errors.Is(err, database.ErrAlreadyExists) {
-		respondWithError(w, http.StatusConflict, err.Error())
-		return
-	}
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	respondWith(w, http.StatusCreated, dbUserToResponseUser(dbUser))
-}
-
-func (c *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
-	type parameters struct {
-		Password string `json:"password"`
-		Email    string `json:"email"`
-	}
-	type response struct {
-		responseUser
-		AccessToken  string `json:"token"`
-		RefreshToken string `json:"refresh_token"`
-	}
-
-	decoder := json.NewDecoder(r.Body)
-	params := parameters{}
-
-	err := decoder.Decode(&params)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid input")
-		return
-	}
-
-	dbUser, err := c.db.GetUserByEmail(params.Email)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not find user")
-		return
-	}
-
-	correctPassword := auth.CheckPassword(params.Password, dbUser.HashedPassword)
-	if !correctPassword {
-		respondWithError(w, http.StatusUnauthorized, "Invalid credentials")
-		return
-	}
-
-	accessToken, err := auth.GetAccessToken(c.jwtSecret, dbUser.ID)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	refreshToken, err := auth.GetRefreshToken(c.jwtSecret, dbUser.ID)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	respondWith(w, http.StatusOK, response{
-		responseUser: dbUserToResponseUser(dbUser),
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-	})
-}
-
-func (c *apiConfig) handlerUpdateUser(w http.ResponseWriter, r *http.Request) {
-	id, err := auth.GetUserIDFromAccessToken(c.jwtSecret, r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
-		return
-	}
-
-	type parameters struct {
-		Password string `json:"password"`
-		Email    string `json:"email"`
-	}
-
-	decoder := json.NewDecoder(r.Body)
-	params := parameters{}
-
-	err = decoder.Decode(&params)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid input")
-		return
-	}
-
-	hashedPassword, err := auth.HashPassword(params.Password)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	dbUser, err := c.db.UpdateUser(id, params.Email, hashedPassword)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	respondWith(w, http.StatusOK, dbUserToResponseUser(dbUser))
-}
-
-func (c *apiConfig) handlerRefreshToken(w http.ResponseWriter, r *http.Request) {
-	type response struct {
-		Token string `json:"token"`
-	}
-
-	userId, err := auth.GetUserIDFromRefreshToken(c.jwtSecret, r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
-		return
-	}
-
-	refreshToken, err := auth.GetTokenFromHeaders(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
-		return
-	}
-
-	isRevoked, err := c.db.IsTokenRevoked(refreshToken)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-	if isRevoked {
-		respondWithError(w, http.StatusUnauthorized, "Token already revoked")
-		return
-	}
-
-	newAccessToken, err := auth.GetAccessToken(c.jwtSecret, userId)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	respondWith(w, http.StatusOK, response{Token: newAccessToken})
-}
-
-func (c *apiConfig) handlerRevokeToken(w http.ResponseWriter, r *http.Request) {
-	_, err := auth.GetUserIDFromRefreshToken(c.jwtSecret, r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
-		return
-	}
-
-	token, err := auth.GetTokenFromHeaders(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Could not find token")
-		return
-	}
-
-	err = c.db.AddRevokedToken(token)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not revoke token")
-		return
-	}
-
-	w.WriteHeader(http.StatusOK)
-}
-
-func (c *apiConfig) handlerPaintUserRed(w http.ResponseWriter, r *http.Request) {
-	type parameters struct {
-		Event string `json:"event"`
-		Data  struct {
-			UserID int `json:"user_id"`
-		} `json:"data"`
-	}
-
-	authApiKey := r.Header.Get("Authorization")
-	if authApiKey != "ApiKey "+c.polkaApiKey {
-		respondWithError(w, http.StatusUnauthorized, "Invalid API key")
-		return
-	}
-
-	decoder := json.NewDecoder(r.Body)
-	params := parameters{}
-	err := decoder.Decode(&params)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid input")
-		return
-	}
-
-	if params.Event != "user.upgraded" {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-
-	err = c.db.PaintUserRed(params.Data.UserID)
-	if err != nil {
-		if errors.Is(err, database.ErrNotExists) {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-		respondWithError(w, http.StatusInternalServerError, "Could not update user")
-		return
-	}
-
-	w.WriteHeader(http.StatusOK)
-}
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/speady1445/web_server_course/internals/auth"
+	"github.com/speady1445/web_server_course/internals/database"
+)
+
+type responseUser struct {
+	ID          int       `json:"id"`
+	Email       string    `json:"email"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func dbUserToResponseUser(dbUser database.User) responseUser {
+	return responseUser{
+		ID:          dbUser.ID,
+		Email:       dbUser.Email,
+		IsChirpyRed: dbUser.IsChirpyRed,
+		CreatedAt:   dbUser.CreatedAt,
+		UpdatedAt:   dbUser.UpdatedAt,
+	}
+}
+
+func (c *apiConfig) handlerAddUser(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Password string `json:"password"`
+		Email    string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid input")
+		return
+	}
+
+	hash, err := auth.HashPassword(params.Password)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	dbUser, err := c.db.CreateUser(params.Email, hash)
+	if errors.Is(err, database.ErrAlreadyExists) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWith(w, http.StatusCreated, dbUserToResponseUser(dbUser))
+}
+
+func (c *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Password string `json:"password"`
+		Email    string `json:"email"`
+	}
+	type response struct {
+		responseUser
+		AccessToken  string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid input")
+		return
+	}
+
+	dbUser, err := c.db.GetUserByEmail(params.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not find user")
+		return
+	}
+
+	correctPassword := auth.CheckPassword(params.Password, dbUser.HashedPassword)
+	if !correctPassword {
+		respondWithError(w, http.StatusUnauthorized, "Invalid credentials")
+		return
+	}
+
+	refreshToken, refreshTokenHash, err := auth.NewRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	accessClaims, err := auth.NewAccessClaims()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	session, err := c.db.CreateSession(dbUser.ID, clientOf(r), database.SessionTokens{
+		RefreshTokenHash: refreshTokenHash,
+		RefreshExpiresAt: time.Now().Add(auth.RefreshTokenLifetime),
+		AccessTokenID:    accessClaims.ID,
+		AccessExpiresAt:  accessClaims.ExpiresAt,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not create session")
+		return
+	}
+
+	accessClaims.UserID = dbUser.ID
+	accessClaims.SessionID = session.ID
+	accessClaims.TokenVersion = dbUser.TokenVersion
+	accessToken, err := auth.GetAccessToken(c.jwtKeys, accessClaims)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWith(w, http.StatusOK, response{
+		responseUser: dbUserToResponseUser(dbUser),
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	})
+}
+
+func (c *apiConfig) handlerUpdateUser(w http.ResponseWriter, r *http.Request) {
+	claims, err := c.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	id := claims.UserID
+
+	type parameters struct {
+		Password string `json:"password"`
+		Email    string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid input")
+		return
+	}
+
+	dbUser, err := c.db.GetUser(id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// only a new password is hashed again, which rejects the access tokens issued so far
+	// and logs out every other session
+	hashedPassword := dbUser.HashedPassword
+	if !auth.CheckPassword(params.Password, dbUser.HashedPassword) {
+		hashedPassword, err = auth.HashPassword(params.Password)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	dbUser, err = c.db.UpdateUser(id, params.Email, hashedPassword, claims.SessionID)
+	if errors.Is(err, database.ErrAlreadyExists) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWith(w, http.StatusOK, dbUserToResponseUser(dbUser))
+}
+
+// handlerDeleteUser deletes the user of the access token together with its chirps.
+// It can be restored within the restore window.
+func (c *apiConfig) handlerDeleteUser(w http.ResponseWriter, r *http.Request) {
+	claims, err := c.authenticate(r)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid access token.")
+		return
+	}
+
+	err = c.db.DeleteUser(claims.UserID)
+	if errors.Is(err, database.ErrNotExists) {
+		respondWithError(w, http.StatusNotFound, "User not found.")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error deleting user.")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlerRestoreUser undeletes a user that proves it with its email and password
+func (c *apiConfig) handlerRestoreUser(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Password string `json:"password"`
+		Email    string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid input")
+		return
+	}
+
+	dbUser, err := c.db.GetDeletedUserByEmail(params.Email)
+	if errors.Is(err, database.ErrNotExists) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid credentials")
+		return
+	}
+	if errors.Is(err, database.ErrNotDeleted) {
+		respondWithError(w, http.StatusConflict, "User is not deleted.")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error restoring user.")
+		return
+	}
+
+	if !auth.CheckPassword(params.Password, dbUser.HashedPassword) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid credentials")
+		return
+	}
+
+	dbUser, err = c.db.RestoreUser(dbUser.ID, time.Now().Add(-c.restoreWindow))
+	if errors.Is(err, database.ErrNotExists) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid credentials")
+		return
+	}
+	if errors.Is(err, database.ErrNotDeleted) {
+		respondWithError(w, http.StatusConflict, "User is not deleted.")
+		return
+	}
+	if errors.Is(err, database.ErrRestoreExpired) {
+		respondWithError(w, http.StatusGone, "User was deleted too long ago to restore.")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error restoring user.")
+		return
+	}
+
+	respondWith(w, http.StatusOK, dbUserToResponseUser(dbUser))
+}
+
+// handlerRefreshToken trades a refresh token for a new access token and a new refresh token.
+// The old refresh token can't be used again: replaying it revokes every token of the login.
+func (c *apiConfig) handlerRefreshToken(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	oldRefreshToken, err := auth.GetTokenFromHeaders(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	refreshToken, refreshTokenHash, err := auth.NewRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	accessClaims, err := auth.NewAccessClaims()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	tokens := database.SessionTokens{
+		RefreshTokenHash: refreshTokenHash,
+		RefreshExpiresAt: time.Now().Add(auth.RefreshTokenLifetime),
+		AccessTokenID:    accessClaims.ID,
+		AccessExpiresAt:  accessClaims.ExpiresAt,
+	}
+
+	if auth.IsLegacyRefreshToken(oldRefreshToken) {
+		// a JWT from before refresh tokens were opaque is exchanged once for an opaque one
+		userID, err := auth.GetUserIDFromRefreshToken(c.jwtKeys, r.Header)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		oldExpiresAt, err := auth.GetRefreshTokenExpiry(c.jwtKeys, r.Header)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		session, err := c.db.ExchangeLegacyRefreshToken(oldRefreshToken, oldExpiresAt, userID, clientOf(r), tokens)
+		if errors.Is(err, database.ErrTokenRevoked) {
+			respondWithError(w, http.StatusUnauthorized, "Token already revoked")
+			return
+		}
+		if errors.Is(err, database.ErrNotExists) {
+			respondWithError(w, http.StatusUnauthorized, "Unknown user")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Could not create session")
+			return
+		}
+		accessClaims.UserID, accessClaims.SessionID = userID, session.ID
+	} else {
+		token, err := c.db.RotateRefreshToken(auth.HashRefreshToken(oldRefreshToken), tokens)
+		if errors.Is(err, database.ErrNotExists) {
+			respondWithError(w, http.StatusUnauthorized, "Invalid token")
+			return
+		}
+		if errors.Is(err, database.ErrTokenRevoked) || errors.Is(err, database.ErrTokenExpired) || errors.Is(err, database.ErrTokenReused) {
+			respondWithError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Could not rotate refresh token")
+			return
+		}
+		accessClaims.UserID, accessClaims.SessionID = token.UserID, token.Family
+	}
+
+	dbUser, err := c.db.GetUser(accessClaims.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unknown user")
+		return
+	}
+
+	accessClaims.TokenVersion = dbUser.TokenVersion
+	newAccessToken, err := auth.GetAccessToken(c.jwtKeys, accessClaims)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWith(w, http.StatusOK, response{Token: newAccessToken, RefreshToken: refreshToken})
+}
+
+// handlerRevokeToken revokes a refresh token together with all tokens of its login
+func (c *apiConfig) handlerRevokeToken(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetTokenFromHeaders(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	if auth.IsLegacyRefreshToken(token) {
+		expiresAt, err := auth.GetRefreshTokenExpiry(c.jwtKeys, r.Header)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		err = c.db.AddRevokedToken(token, expiresAt)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Could not revoke token")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	err = c.db.RevokeRefreshToken(auth.HashRefreshToken(token))
+	if errors.Is(err, database.ErrNotExists) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not revoke token")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (c *apiConfig) handlerPaintUserRed(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Event string `json:"event"`
+		Data  struct {
+			UserID int `json:"user_id"`
+		} `json:"data"`
+	}
+
+	authApiKey := r.Header.Get("Authorization")
+	if authApiKey != "ApiKey "+c.polkaApiKey {
+		respondWithError(w, http.StatusUnauthorized, "Invalid API key")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid input")
+		return
+	}
+
+	if params.Event != "user.upgraded" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	err = c.db.PaintUserRed(params.Data.UserID)
+	if err != nil {
+		if errors.Is(err, database.ErrNotExists) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Could not update user")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}